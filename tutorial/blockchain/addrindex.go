@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"bytes"
+)
+
+const (
+	addrIndexVersion = 2 //Version 2 keys have the length of the public key hash before it
+)
+
+var (
+	addrPrefix   = []byte("addr-")
+	addrIndexKey = []byte("addrindex") //Set to addrIndexVersion once the address index covers the whole UTXO set
+)
+
+//addrEntries is the prefix of every address index key of a public key hash. The hash's length comes first, so the
+//keys of a longer hash that starts with this one aren't under it
+func addrEntries(pubKeyHash []byte) []byte {
+	return append(append(append([]byte{}, addrPrefix...), byte(len(pubKeyHash))), pubKeyHash...)
+}
+
+//addrEntry is the key that says the unspent output at the outpoint is locked to the public key hash
+func addrEntry(pubKeyHash, txID []byte, out int) []byte {
+	return append(addrEntries(pubKeyHash), outpointKey(txID, out)...)
+}
+
+func indexOutput(batch Batch, txID []byte, out int, output TxOutput) error {
+	return batch.Put(addrEntry(output.PubKeyHash, txID, out), []byte{})
+}
+
+func unindexOutput(batch Batch, txID []byte, out int, output TxOutput) error {
+	return batch.Delete(addrEntry(output.PubKeyHash, txID, out))
+}
+
+//ownedOutputs calls fn with every unspent output locked to the public key hash, along with its outpoint.
+//Only the outpoints the address index lists for it are read
+func (u UTXOSet) ownedOutputs(pubKeyHash []byte, fn func(txID []byte, out int, utxo UTXO)) error {
+	db := u.BlockChain.Database
+	prefix := addrEntries(pubKeyHash)
+
+	var outpoints [][]byte
+	err := db.Iterate(prefix, func(key, value []byte) error {
+		outpoints = append(outpoints, bytes.TrimPrefix(key, prefix))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, outpoint := range outpoints {
+		txID, out, err := splitOutpointKey(outpoint)
+		if err != nil {
+			return err
+		}
+
+		utxo, found, err := u.FindUTXO(txID, out)
+		if err != nil {
+			return err
+		}
+		if found && utxo.Output.IsLockedWithKey(pubKeyHash) {
+			fn(txID, out, utxo)
+		}
+	}
+
+	return nil
+}
+
+//ReindexAddresses rebuilds the address index from the UTXO set
+func (u UTXOSet) ReindexAddresses() error {
+	db := u.BlockChain.Database
+
+	if err := db.Delete(addrIndexKey); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(addrPrefix); err != nil {
+		return err
+	}
+
+	err := db.Iterate(utxoPrefix, func(key, value []byte) error {
+		txID, out, err := splitOutpointKey(key[prefixLength:])
+		if err != nil {
+			return err
+		}
+		utxo, err := DeserializeUTXO(value)
+		if err != nil {
+			return err
+		}
+
+		return db.Update(func(batch Batch) error {
+			return indexOutput(batch, txID, out, utxo.Output)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.Put(addrIndexKey, []byte{addrIndexVersion})
+}
+
+//hasAddrIndex says whether the address index has been built with the current keys, which it hasn't for chains from
+//before there was one, or from before the keys had the length of the public key hash
+func hasAddrIndex(db Reader) (bool, error) {
+	version, err := db.Get(addrIndexKey)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(version, []byte{addrIndexVersion}), nil
+}
@@ -0,0 +1,82 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+//An output locked to a longer hash starting with another owner's hash used to be listed under that owner's keys,
+//and fail to split into an outpoint
+func TestAddrIndexLongerHash(t *testing.T) {
+	owner := newWallet(t)
+	chain := newTestChain(t, owner)
+
+	longer := append(wallet.PublicKeyHash(owner.PublicKey), 0x00)
+	err := chain.Database.Update(func(batch Batch) error {
+		return indexOutput(batch, make([]byte, txIDLength), 0, TxOutput{Value: 50, PubKeyHash: longer})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := balance(t, chain, owner); got != 100 {
+		t.Errorf("owner has %d, want 100", got)
+	}
+}
+
+//Outputs can only be locked to hashes of the length every public key hashes to
+func TestPubKeyHashLength(t *testing.T) {
+	owner := newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	versioned := append([]byte{chaincfg.Active.AddressVersion}, make([]byte, wallet.PubKeyHashLength+1)...)
+	longAddress := string(wallet.Base58Encode(append(versioned, wallet.Checksum(versioned)...)))
+	if _, err := NewTxOutput(10, longAddress); !errors.Is(err, wallet.ErrInvalidAddress) {
+		t.Errorf("locking to %s: got %v, want %v", longAddress, err, wallet.ErrInvalidAddress)
+	}
+
+	for _, length := range []int{0, wallet.PubKeyHashLength - 1, wallet.PubKeyHashLength + 1} {
+		block := newTestBlock(t, chain, genesis, owner, func(b *Block) {
+			b.Transactions[0].Outputs[0].PubKeyHash = make([]byte, length)
+			b.Transactions[0].SetID()
+			b.MerkleRoot = b.HashTransactions()
+		})
+		if err := chain.ValidateBlock(block); !errors.Is(err, ErrBadPubKeyHash) {
+			t.Errorf("output locked to %d bytes: got %v, want %v", length, err, ErrBadPubKeyHash)
+		}
+	}
+}
+
+//An address index from before its keys had the hash's length is rebuilt when the chain is opened
+func TestAddrIndexRebuilt(t *testing.T) {
+	owner := newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	coinbase := genesis.Transactions[0]
+	oldKey := append(append(append([]byte{}, addrPrefix...), wallet.PublicKeyHash(owner.PublicKey)...), outpointKey(coinbase.ID, 0)...)
+	if err := chain.Database.Put(oldKey, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Database.Put(addrIndexKey, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := LoadBlockChain(chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Database.Get(oldKey); err != ErrNotFound {
+		t.Errorf("old key %x is still there, %v", oldKey, err)
+	}
+	if version, err := chain.Database.Get(addrIndexKey); err != nil || !bytes.Equal(version, []byte{addrIndexVersion}) {
+		t.Errorf("address index is at version %v, %v, want %d", version, err, addrIndexVersion)
+	}
+	if got := balance(t, chain, owner); got != 100 {
+		t.Errorf("owner has %d, want 100", got)
+	}
+}
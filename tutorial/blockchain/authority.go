@@ -0,0 +1,379 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AuthorityPeriod    = 1  //Least number of seconds between two signed blocks
+	OutOfTurnDelay     = 20 //Seconds a signer waits past the period before signing out of turn
+	authorityPubKeyLen = 20 //Length of the public key hashes authorities are known by
+)
+
+var (
+	proposalsKey = []byte("proposals") //Votes this node's signer casts whenever it signs a block
+
+	ErrUnauthorizedSigner = errors.New("signer is not an authority")
+	ErrSignedRecently     = errors.New("signer has signed one of the most recent blocks")
+	ErrLastAuthority      = errors.New("vote would remove the last authority")
+)
+
+//ProofOfAuthorityEngine has a fixed set of authorities take turns signing blocks, for private networks where the
+//signers are known and nobody has to be kept out by mining.
+//The authorities are ordered by public key hash, and the one at the block's height modulo their number is in turn.
+//An in turn block has Bits 1, worth twice an out of turn block's Bits 0, so the in turn signer wins any fork.
+//Any other authority can sign out of turn after waiting OutOfTurnDelay, which keeps the chain going when the in turn
+//signer is down, but no authority can sign more than one in every len(authorities)/2+1 blocks.
+//The chain starts with the network's authorities. They vote to add and remove authorities in the blocks they sign,
+//and a vote passes once more than half of them have last voted the same way on the same candidate. The last authority
+//can't be voted out, as nobody could sign a block after that
+type ProofOfAuthorityEngine struct{}
+
+func (ProofOfAuthorityEngine) Name() string {
+	return ConsensusProofOfAuthority
+}
+
+func (ProofOfAuthorityEngine) Prepare(chain *BlockChain, block *Block) error {
+	if chain.Signer == nil {
+		return ErrNoSigner
+	}
+
+	signers, err := chain.Authorities(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	signer := wallet.PublicKeyHash(chain.Signer.PublicKey)
+	if indexOf(signers, signer) < 0 {
+		return ErrUnauthorizedSigner
+	}
+
+	block.Signer = chain.Signer.PublicKey
+	block.Bits = 0
+	if inTurn(signers, block.Height, signer) {
+		block.Bits = 1
+	}
+
+	//Cast the first proposal that would still change the authorities
+	proposals, err := chain.Proposals()
+	if err != nil {
+		return err
+	}
+	candidates := make([]string, 0, len(proposals))
+	for candidate := range proposals {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	block.Vote = nil
+	block.VoteAdd = false
+	for _, candidate := range candidates {
+		pubKeyHash, _ := hex.DecodeString(candidate)
+		if !proposals[candidate] && len(signers) == 1 {
+			continue
+		}
+		if (indexOf(signers, pubKeyHash) >= 0) != proposals[candidate] {
+			block.Vote = pubKeyHash
+			block.VoteAdd = proposals[candidate]
+			break
+		}
+	}
+
+	return nil
+}
+
+//Seal waits out the period since the parent, and the out of turn delay if the chain's Signer isn't in turn, then signs
+func (ProofOfAuthorityEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	if chain.Signer == nil {
+		return ErrNoSigner
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	signers, err := chain.Authorities(parent.Hash)
+	if err != nil {
+		return err
+	}
+	if chain.signedRecently(&parent, len(signers), wallet.PublicKeyHash(chain.Signer.PublicKey)) {
+		return ErrSignedRecently
+	}
+
+	at := parent.Timestamp + AuthorityPeriod
+	if now := time.Now().Unix(); now > at {
+		at = now
+	}
+	if block.Bits == 0 {
+		at += OutOfTurnDelay
+	}
+
+	timer := time.NewTimer(time.Until(time.Unix(at, 0)))
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	block.Timestamp = at
+	block.Nonce = 0
+	block.Hash = block.HeaderHash()
+
+	return signBlock(block, chain.Signer)
+}
+
+func (ProofOfAuthorityEngine) VerifyHeader(chain *BlockChain, block *Block) error {
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return blockError(block, ErrUnknownParent, "%x", block.PrevHash)
+	}
+
+	signers, err := chain.Authorities(parent.Hash)
+	if err != nil {
+		return err
+	}
+	signer := wallet.PublicKeyHash(block.Signer)
+	if indexOf(signers, signer) < 0 {
+		return blockError(block, ErrUnauthorizedSigner, "%x", signer)
+	}
+
+	if bytes.Compare(block.Hash, block.HeaderHash()) != 0 || !verifyBlockSignature(block) {
+		return blockError(block, ErrBadSeal, "signature is not valid")
+	}
+
+	expectedBits := 0
+	if inTurn(signers, block.Height, signer) {
+		expectedBits = 1
+	}
+	if block.Bits != expectedBits {
+		return blockError(block, ErrBadSeal, "bits %d, expected %d", block.Bits, expectedBits)
+	}
+
+	if block.Timestamp < parent.Timestamp+AuthorityPeriod {
+		return blockError(block, ErrBadSeal, "signed less than %d seconds after its parent", AuthorityPeriod)
+	}
+	if block.Timestamp > time.Now().Add(MaxFutureBlockTime).Unix() {
+		return blockError(block, ErrBadSeal, "timestamp is in the future")
+	}
+
+	if chain.signedRecently(&parent, len(signers), signer) {
+		return blockError(block, ErrSignedRecently, "%x", signer)
+	}
+
+	if len(block.Vote) > 0 {
+		if len(block.Vote) != authorityPubKeyLen {
+			return blockError(block, ErrBadSeal, "vote is not a public key hash")
+		}
+		if (indexOf(signers, block.Vote) >= 0) == block.VoteAdd {
+			return blockError(block, ErrBadSeal, "vote for %x would not change the authorities", block.Vote)
+		}
+		if !block.VoteAdd && len(signers) == 1 {
+			return blockError(block, ErrLastAuthority, "%x", block.Vote)
+		}
+	}
+
+	return nil
+}
+
+//authorityCache keeps the authorities and the votes cast so far as of every block Authorities has replayed the votes
+//up to, so the votes of a branch aren't replayed from the genesis block for each block verified on it
+type authorityCache struct {
+	mutex  sync.Mutex
+	states map[string]*authorityState //Block hash to the state as of that block
+}
+
+type authorityState struct {
+	signers map[string]bool
+	votes   map[string]map[string]bool //Candidate to voter to whether they voted to add
+}
+
+//vote counts the vote the block casts, if any. A block without one leaves the state as it is, otherwise it returns
+//a new state with the vote counted
+func (state *authorityState) vote(block *Block) *authorityState {
+	if len(block.Vote) == 0 {
+		return state
+	}
+
+	next := &authorityState{make(map[string]bool), make(map[string]map[string]bool)}
+	for signer := range state.signers {
+		next.signers[signer] = true
+	}
+	for candidate, cast := range state.votes {
+		next.votes[candidate] = make(map[string]bool)
+		for voter, add := range cast {
+			next.votes[candidate][voter] = add
+		}
+	}
+
+	candidate := hex.EncodeToString(block.Vote)
+	voter := hex.EncodeToString(wallet.PublicKeyHash(block.Signer))
+	if next.votes[candidate] == nil {
+		next.votes[candidate] = make(map[string]bool)
+	}
+	next.votes[candidate][voter] = block.VoteAdd
+
+	tally := 0
+	for voter, add := range next.votes[candidate] {
+		if next.signers[voter] && add == block.VoteAdd {
+			tally++
+		}
+	}
+	if tally <= len(next.signers)/2 {
+		return next
+	}
+
+	delete(next.votes, candidate)
+	if block.VoteAdd {
+		next.signers[candidate] = true
+	} else {
+		delete(next.signers, candidate)
+		for _, cast := range next.votes {
+			delete(cast, candidate) //A removed authority's votes don't count any more
+		}
+	}
+
+	return next
+}
+
+//Authorities replays the votes on the branch ending at the given block, and returns the authorities that can sign
+//the block after it, ordered by public key hash. Votes are replayed from the last block on the branch they were
+//replayed up to before
+func (chain *BlockChain) Authorities(blockHash []byte) ([][]byte, error) {
+	cache := &chain.authorities
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cache.states == nil {
+		cache.states = make(map[string]*authorityState)
+	}
+
+	var branch []*Block
+	state := cache.states[string(blockHash)]
+	iter := &BlockChainIterator{blockHash, chain.Database}
+	for state == nil {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(block.PrevHash) == 0 {
+			state = &authorityState{make(map[string]bool), make(map[string]map[string]bool)}
+			for _, signer := range initialAuthorities(block) {
+				state.signers[hex.EncodeToString(signer)] = true
+			}
+			cache.states[string(block.Hash)] = state
+			break
+		}
+
+		branch = append(branch, block)
+		state = cache.states[string(iter.CurrentHash)]
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		state = state.vote(branch[i])
+		cache.states[string(branch[i].Hash)] = state
+	}
+
+	var authorities [][]byte
+	for signer := range state.signers {
+		pubKeyHash, _ := hex.DecodeString(signer)
+		authorities = append(authorities, pubKeyHash)
+	}
+	sort.Slice(authorities, func(i, j int) bool {
+		return bytes.Compare(authorities[i], authorities[j]) < 0
+	})
+
+	return authorities, nil
+}
+
+//initialAuthorities are the active network's, or the owner of the genesis coinbase if it has none
+func initialAuthorities(genesis *Block) [][]byte {
+	if len(chaincfg.Active.Authorities) > 0 {
+		return chaincfg.Active.Authorities
+	}
+	return [][]byte{genesis.Transactions[0].Outputs[0].PubKeyHash}
+}
+
+//Propose has this node's signer vote to add or remove an authority in every block it signs, until the vote passes
+func (chain *BlockChain) Propose(pubKeyHash []byte, add bool) error {
+	proposals, err := chain.Proposals()
+	if err != nil {
+		return err
+	}
+	proposals[hex.EncodeToString(pubKeyHash)] = add
+
+	return chain.Database.Put(proposalsKey, serializeProposals(proposals))
+}
+
+//Proposals maps the hex public key hash of each candidate this node's signer votes on to whether it votes to add them
+func (chain *BlockChain) Proposals() (map[string]bool, error) {
+	proposals := make(map[string]bool)
+
+	val, err := chain.Database.Get(proposalsKey)
+	if err == ErrNotFound {
+		return proposals, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializeProposals(val)
+}
+
+func serializeProposals(proposals map[string]bool) []byte {
+	var e Encoder
+	encodeProposals(&e, proposals)
+	return e.Bytes()
+}
+
+func deserializeProposals(data []byte) (map[string]bool, error) {
+	d := NewDecoder(data)
+	proposals := decodeProposals(d)
+	if err := d.Finish("proposals"); err != nil {
+		return nil, err
+	}
+	return proposals, nil
+}
+
+//signedRecently checks whether the signer signed one of the last signers/2 blocks up to and including parent
+func (chain *BlockChain) signedRecently(parent *Block, signers int, signer []byte) bool {
+	block := parent
+	for i := 0; i < signers/2; i++ {
+		if len(block.PrevHash) == 0 {
+			return false
+		}
+		if bytes.Compare(wallet.PublicKeyHash(block.Signer), signer) == 0 {
+			return true
+		}
+
+		previous, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return false
+		}
+		block = &previous
+	}
+
+	return false
+}
+
+func inTurn(signers [][]byte, height int, signer []byte) bool {
+	return len(signers) > 0 && bytes.Compare(signers[height%len(signers)], signer) == 0
+}
+
+func indexOf(pubKeyHashes [][]byte, pubKeyHash []byte) int {
+	for i, candidate := range pubKeyHashes {
+		if bytes.Compare(candidate, pubKeyHash) == 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//Authorities replayed from a cache left at another block, on the same branch or another one, have to be the ones
+//replayed from the genesis block
+func TestAuthoritiesCache(t *testing.T) {
+	owner, second, third := newWallet(t), newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	//Votes are counted from the block's Signer and Vote whatever engine sealed it
+	vote := func(parent *Block, signer, candidate *wallet.Wallet, add bool) *Block {
+		block := newTestBlock(t, chain, parent, signer, func(b *Block) {
+			b.Signer = signer.PublicKey
+			b.Vote = wallet.PublicKeyHash(candidate.PublicKey)
+			b.VoteAdd = add
+		})
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		return block
+	}
+
+	added := vote(genesis, owner, second, true)    //Passes with the only authority's vote
+	pending := vote(added, second, third, true)    //One of two
+	passed := vote(pending, owner, third, true)    //Two of two
+	removing := vote(passed, owner, second, false) //One of three
+	side := vote(added, owner, second, false)      //Removes second on a side branch, one of two isn't enough
+
+	tests := []struct {
+		block *Block
+		want  int //Number of authorities after it
+	}{
+		{genesis, 1},
+		{added, 2},
+		{pending, 2},
+		{passed, 3},
+		{removing, 3},
+		{side, 2},
+	}
+
+	//Out of order, and back and forth between the branches
+	for _, i := range []int{4, 1, 5, 3, 0, 2, 4, 5} {
+		test := tests[i]
+		authorities, err := chain.Authorities(test.block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncached := &BlockChain{LastHash: chain.LastHash, Database: chain.Database, Engine: chain.Engine}
+		want, err := uncached.Authorities(test.block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(authorities, want) {
+			t.Errorf("authorities at height %d are %x, want %x", test.block.Height, authorities, want)
+		}
+		if len(want) != test.want {
+			t.Errorf("%d authorities at height %d, want %d", len(want), test.block.Height, test.want)
+		}
+	}
+}
+
+//A proposals record that doesn't decode used to be a panic
+func TestProposalsCorrupt(t *testing.T) {
+	chain := newTestChain(t, newWallet(t))
+	if err := chain.Database.Put(proposalsKey, []byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := chain.Proposals(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want %v", err, ErrCorrupt)
+	}
+	if err := chain.Propose(make([]byte, authorityPubKeyLen), true); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("got %v, want %v", err, ErrCorrupt)
+	}
+}
+
+//A chain starts with the network's authorities, and with the genesis coinbase's owner when the network has none
+func TestInitialAuthorities(t *testing.T) {
+	owner, second, third := newWallet(t), newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+
+	authorities, err := chain.Authorities(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{wallet.PublicKeyHash(owner.PublicKey)}; !reflect.DeepEqual(authorities, want) {
+		t.Errorf("authorities are %x, want the genesis owner %x", authorities, want)
+	}
+
+	want := [][]byte{wallet.PublicKeyHash(second.PublicKey), wallet.PublicKeyHash(third.PublicKey)}
+	if bytes.Compare(want[0], want[1]) > 0 {
+		want[0], want[1] = want[1], want[0]
+	}
+	chaincfg.Active.Authorities = [][]byte{want[1], want[0]}
+	uncached := &BlockChain{LastHash: chain.LastHash, Database: chain.Database, Engine: chain.Engine}
+	authorities, err = uncached.Authorities(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(authorities, want) {
+		t.Errorf("authorities are %x, want the network's %x", authorities, want)
+	}
+}
+
+//Voting out the only authority would leave nobody to sign the next block, so the vote isn't cast, and a block
+//casting it is refused
+func TestLastAuthorityKept(t *testing.T) {
+	owner := newWallet(t)
+	chain := newTestChain(t, owner)
+	chain.Engine = ProofOfAuthorityEngine{}
+	chain.Signer = owner
+
+	ownerHash := wallet.PublicKeyHash(owner.PublicKey)
+	if err := chain.Propose(ownerHash, false); err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := CoinbaseTx(address(owner), "", BlockSubsidy(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock([]*Transaction{coinbase}, chain.LastHash, 1, 0)
+	if err := chain.Engine.Prepare(chain, block); err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Vote) != 0 {
+		t.Errorf("block votes on %x", block.Vote)
+	}
+
+	block.Vote = ownerHash
+	block.VoteAdd = false
+	if err := chain.Engine.Seal(context.Background(), chain, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(block); !errors.Is(err, ErrLastAuthority) {
+		t.Errorf("got %v, want %v", err, ErrLastAuthority)
+	}
+}
@@ -1,65 +1,157 @@
 package blockchain
 
 import (
-	"bytes"
+	"GolangBlockchain/tutorial/chaincfg"
+	"context"
 	"crypto/sha256"
-	"encoding/gob"
-	"log"
+	"math/big"
+	"time"
 )
 
+const (
+	BlockVersion = 2 //Version 2 blocks hash and sign their transactions over the binary encoding, see legacy.go for version 1
+)
+
+//BlockHeader holds everything the proof of work is computed over. The transactions are only committed to through the MerkleRoot
+type BlockHeader struct {
+	Version    int
+	Height     int
+	Timestamp  int64
+	PrevHash   []byte
+	MerkleRoot []byte
+	Bits       int    //The difficulty the block was mined at
+	Signer     []byte //Public key of the validator that signed the block, for engines that sign blocks instead of mining them
+	Vote       []byte //Public key hash of a proof of authority signer the block's signer votes to add or remove
+	VoteAdd    bool
+	Nonce      uint32
+}
+
 type Block struct {
+	BlockHeader
 	Hash         []byte
+	Signature    []byte //The Signer's signature of Hash
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
 }
 
+//HashTransactions returns the root of the merkle tree built from the block's transaction IDs
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-	var txHash [32]byte
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	tree := NewMerkleTree(txIDs)
 
-	return txHash[:]
+	return tree.RootNode.Data
 }
 
-func CreateBlock(transactions []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, transactions, prevHash, 0}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+//MerkleProof proves that the transaction with txID is committed to by this block's merkle root
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	var txIDs [][]byte
+
+	for _, tx := range b.Transactions {
+		txIDs = append(txIDs, tx.ID)
+	}
+	tree := NewMerkleTree(txIDs)
+
+	return tree.Proof(txID)
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+//CreateBlock builds a block and mines it
+func CreateBlock(transactions []*Transaction, prevHash []byte, height, bits int) (*Block, error) {
+	block := NewBlock(transactions, prevHash, height, bits)
+	if err := block.Mine(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+//NewBlock builds a block without mining it. It gets its nonce and hash from Mine
+func NewBlock(transactions []*Transaction, prevHash []byte, height, bits int) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			Height:    height,
+			Timestamp: time.Now().Unix(),
+			PrevHash:  prevHash,
+			Bits:      bits,
+		},
+		Hash:         []byte{},
+		Transactions: transactions,
+	}
+	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+//Mine runs the proof of work for the block and fills in its nonce and hash.
+//Whenever no nonce works, the header is changed and the search starts over: the timestamp moves up to the current time,
+//or if it is already there, the coinbase's extra nonce is bumped, which changes the merkle root.
+//It only stops without a hash if ctx is cancelled, or if the block has no coinbase to bump
+func (b *Block) Mine(ctx context.Context) error {
+	for {
+		nonce, hash, err := NewProof(b).Run(ctx)
+		if err == nil {
+			b.Hash = hash
+			b.Nonce = nonce
+			return nil
+		}
+		if err != ErrNonceSpaceExhausted {
+			return err
+		}
+
+		if now := time.Now().Unix(); now > b.Timestamp {
+			b.Timestamp = now
+			continue
+		}
+		if len(b.Transactions) == 0 || !b.Transactions[0].IsCoinbase() {
+			return err
+		}
+		b.Transactions[0].IncrementExtraNonce()
+		b.MerkleRoot = b.HashTransactions()
+	}
 }
 
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+//Genesis builds the active network's genesis block from its parameters. Every node builds the same block: its
+//coinbase carries no random data, and it is mined by trying nonces in order and taking the first that meets the target
+func Genesis() (*Block, error) {
+	params := chaincfg.Active
+
+	txin := TxInput{[]byte{}, -1, nil, []byte(params.GenesisData)}
+	txout := TxOutput{BlockSubsidy(0), params.GenesisPubKeyHash}
+	coinbase := &Transaction{nil, []TxInput{txin}, []TxOutput{txout}}
+	coinbase.SetID()
 
-	if err := encoder.Encode(b); err != nil {
-		log.Panic()
+	block := NewBlock([]*Transaction{coinbase}, []byte{}, 0, params.GenesisBits)
+	block.Timestamp = params.GenesisTimestamp
+
+	pow := NewProof(block)
+	var intHash big.Int
+	for nonce := uint64(0); nonce <= MaxNonce; nonce++ {
+		hash := sha256.Sum256(pow.InitializeData(uint32(nonce)))
+		if intHash.SetBytes(hash[:]).Cmp(pow.Target) == -1 {
+			block.Nonce = uint32(nonce)
+			block.Hash = hash[:]
+			return block, nil
+		}
 	}
 
-	return res.Bytes()
+	return nil, ErrNonceSpaceExhausted
 }
 
-func Deserialize(data []byte) *Block {
-	var block Block
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
+func (b *Block) Serialize() []byte {
+	var e Encoder
+	encodeBlock(&e, b)
+	return e.Bytes()
+}
 
-	if err := decoder.Decode(&block); err != nil {
-		log.Panic()
+func Deserialize(data []byte) (*Block, error) {
+	d := NewDecoder(data)
+	block := decodeBlock(d)
+	if err := d.Finish("block"); err != nil {
+		return nil, err
 	}
 
-	return &block
+	return block, nil
 }
@@ -1,57 +1,173 @@
 package blockchain
 
 import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/wallet"
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/dgraph-io/badger"
-	"log"
+	"io/ioutil"
+	"math/big"
 	"os"
-	"runtime"
+	"path/filepath"
 )
 
-const (
-	dbPath      = "./tmp/blocks"
-	dbFile      = "./tmp/blocks/MANIFEST"
-	genesisData = "First Transaction from Genesis"
+var (
+	lastHashKey = []byte("lh")     //Hash of the block at the tip of the best chain
+	blockPrefix = []byte("block-") //Blocks are kept under it and their hash
+
+	ErrChainExists   = errors.New("blockchain already exists")
+	ErrNoChain       = errors.New("no existing blockchain found, need to create one")
+	ErrBlockNotFound = errors.New("block is not found")
+	ErrTxNotFound    = errors.New("transaction does not exist")
+	ErrWrongGenesis  = errors.New("genesis block is not the network's")
 )
 
 type BlockChain struct {
 	LastHash []byte
-	Database *badger.DB
+	Database Store
+	Engine   ConsensusEngine //Seals and verifies every block after the genesis block
+	Signer   *wallet.Wallet  //Key the engine signs new blocks with, for engines that sign them
+
+	stakes      stakeCache
+	authorities authorityCache
 }
 
 type BlockChainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    Reader
 }
 
-func InitializeBlockChain(address string) *BlockChain {
-	var lastHash []byte
+//InitializeBlockChain creates a chain in the database directory path whose blocks after the genesis block are sealed
+//with the named consensus engine. It returns ErrChainExists if there is a chain there already.
+//The consensus engine is checked before anything is written, and if the chain can't be created nothing is left
+//behind in path
+func InitializeBlockChain(path, consensus string) (chain *BlockChain, err error) {
+	if DBexists(path) {
+		return nil, ErrChainExists
+	}
+	if _, err := NewConsensusEngine(consensus); err != nil {
+		return nil, err
+	}
 
-	if DBexists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+	existing, err := listDir(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			removeCreated(path, existing)
+		}
+	}()
 
-	opts := badger.DefaultOptions(dbPath)
+	store, err := OpenBadgerStore(path)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
+	chain, err = CreateBlockChain(store, consensus)
 	if err != nil {
-		log.Panic(err)
+		store.Close()
+		return nil, err
 	}
 
-	err = db.Update(func(transaction *badger.Txn) error {
-		coinbaseTransaction := CoinbaseTx(address, genesisData) //The address that is passed will be rewarded for mining the block
-		genesis := Genesis(coinbaseTransaction)
+	return chain, nil
+}
+
+//listDir returns the names in the directory path, or nil if there is no directory
+func listDir(path string) (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	return names, nil
+}
+
+//removeCreated removes the directory path if it wasn't there before, as given by existing, or otherwise everything
+//in it that wasn't
+func removeCreated(path string, existing map[string]bool) {
+	if existing == nil {
+		os.RemoveAll(path)
+		return
+	}
+
+	entries, _ := ioutil.ReadDir(path)
+	for _, entry := range entries {
+		if !existing[entry.Name()] {
+			os.RemoveAll(filepath.Join(path, entry.Name()))
+		}
+	}
+}
+
+//CreateBlockChain starts a new chain in an empty store from the active network's genesis block
+func CreateBlockChain(store Store, consensus string) (*BlockChain, error) {
+	var lastHash []byte
+
+	engine, err := NewConsensusEngine(consensus)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := Genesis()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Update(func(batch Batch) error {
 		fmt.Println("Genesis Created")
-		if err = transaction.Set(genesis.Hash, genesis.Serialize()); err != nil {
+		if err = batch.Put(blockKey(genesis.Hash), genesis.Serialize()); err != nil {
+			return err
+		}
+
+		if err = batch.Put(lastHashKey, genesis.Hash); err != nil {
+			return err
+		}
+
+		if err = setWork(batch, genesis.Hash, BlockWork(genesis.Bits)); err != nil {
+			return err
+		}
+
+		if err = batch.Put(consensusKey, []byte(engine.Name())); err != nil {
+			return err
+		}
+
+		if err = connectBlock(batch, genesis); err != nil {
+			return err
+		}
+
+		for _, key := range [][]byte{txIndexKey, heightIndexKey} {
+			if err = batch.Put(key, []byte{1}); err != nil {
+				return err
+			}
+		}
+
+		if err = batch.Put(addrIndexKey, []byte{addrIndexVersion}); err != nil {
+			return err
+		}
+
+		if err = batch.Put(utxoVersionKey, []byte{2}); err != nil {
 			return err
 		}
 
-		if err = transaction.Set([]byte("lh"), genesis.Hash); err != nil {
+		if err = batch.Put(encodingKey, []byte{EncodingVersion}); err != nil {
+			return err
+		}
+
+		if err = batch.Put(blockPrefixKey, []byte{1}); err != nil {
 			return err
 		}
 
@@ -61,148 +177,335 @@ func InitializeBlockChain(address string) *BlockChain {
 	})
 
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	blockchain := BlockChain{lastHash, db} //new blockchain in memory
-	return &blockchain
+	blockchain := BlockChain{LastHash: lastHash, Database: store, Engine: engine} //new blockchain in memory
+	return &blockchain, nil
 }
 
-func ContinueBlockChain(address string) *BlockChain {
-	if DBexists() == false {
-		fmt.Println("No existing blockchain found. Need to create one")
-		runtime.Goexit()
+//ContinueBlockChain opens the chain in the database directory path. It returns ErrNoChain if there isn't one yet
+func ContinueBlockChain(path string) (*BlockChain, error) {
+	if DBexists(path) == false {
+		return nil, ErrNoChain
 	}
 
-	var lastHash []byte
+	store, err := OpenBadgerStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := LoadBlockChain(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	opts := badger.DefaultOptions(dbPath)
+	return chain, nil
+}
+
+//LoadBlockChain picks up the chain already kept in a store where it left off
+func LoadBlockChain(store Store) (*BlockChain, error) {
+	lastHash, err := store.Get(lastHashKey)
+	if err == ErrNotFound {
+		return nil, ErrNoChain
+	} else if err != nil {
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
+	consensus := ConsensusProofOfWork //Chains from before there was a choice
+	if name, err := store.Get(consensusKey); err == nil {
+		consensus = string(name)
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	engine, err := NewConsensusEngine(consensus)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
-		}
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
+	chain := &BlockChain{LastHash: lastHash, Database: store, Engine: engine}
+	if err := chain.buildMissingIndexes(); err != nil {
+		return nil, err
+	}
+	if err := chain.checkGenesis(); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
 
+//checkGenesis makes sure the chain starts from the active network's genesis block, so a chain isn't opened as
+//another network's. Chains from before the genesis block was fixed started from one of their own, and are known by
+//its version being older than BlockVersion
+func (chain *BlockChain) checkGenesis() error {
+	hash, err := chain.GetBlockHash(0)
+	if err != nil {
 		return err
-	})
+	}
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+	if block.Version < BlockVersion {
+		return nil
+	}
 
-	return &BlockChain{lastHash, db}
-}
+	genesis, err := Genesis()
+	if err != nil {
+		return err
+	}
+	if bytes.Compare(block.Hash, genesis.Hash) != 0 {
+		return fmt.Errorf("%w: chain starts from %x, %s from %x", ErrWrongGenesis, block.Hash, chaincfg.Active.Name, genesis.Hash)
+	}
 
-func (chain *BlockChain) AddBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
-	var newBlock *Block
+	return nil
+}
 
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
+//buildMissingIndexes builds the indexes a chain from before they were added doesn't have yet, and moves its records
+//over to their current layout. Last, it repairs a UTXO set that isn't at the tip of the chain. Each step can use the
+//ones before it
+func (chain *BlockChain) buildMissingIndexes() error {
+	steps := []struct {
+		doing string
+		done  func(db Reader) (bool, error)
+		run   func() error
+	}{
+		{"Moving blocks under their own prefix", hasBlockPrefix, chain.migrateBlockKeys},
+		{"Moving the database over to the binary encoding", hasBinaryEncoding, chain.migrateEncoding},
+		{"Building the transaction index", hasTxIndex, func() error {
+			_, err := chain.ReindexTransactions()
+			return err
+		}},
+		{"Building the height index", hasHeightIndex, chain.ReindexHeights},
+		{"Moving the UTXO set to one record per output", hasUTXOVersion, UTXOSet{chain}.migrate},
+		{"Building the address index", hasAddrIndex, UTXOSet{chain}.ReindexAddresses},
+		{"The UTXO set is not at the tip of the chain, repairing it", hasUTXOTip, chain.repairUTXOSet},
 	}
 
-	err := chain.Database.View(func(transaction *badger.Txn) error {
-		item, err := transaction.Get([]byte("lh"))
+	for _, step := range steps {
+		done, err := step.done(chain.Database)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
-		if err != nil {
-			log.Panic(err)
+		if !done {
+			fmt.Println(step.doing)
+			if err := step.run(); err != nil {
+				return err
+			}
 		}
+	}
 
-		newBlock = CreateBlock(transactions, lastHash)
+	return nil
+}
 
-		err = chain.Database.Update(func(transaction *badger.Txn) error {
-			if err := transaction.Set(newBlock.Hash, newBlock.Serialize()); err != nil {
-				log.Panic(err)
-			}
+//MineBlock seals a new block on top of the current last hash with the chain's engine, validates it and connects it as the new tip
+func (chain *BlockChain) MineBlock(transactions []*Transaction) (*Block, error) {
+	lastHash, err := chain.Database.Get(lastHashKey)
+	if err != nil {
+		return nil, err
+	}
+	lastBlock, err := getBlock(chain.Database, lastHash)
+	if err != nil {
+		return nil, err
+	}
 
-			if err = transaction.Set([]byte("lh"), newBlock.Hash); err != nil { //Set the new blocks hash as our latest lastHash
-				log.Panic(err)
-			}
+	newBlock := NewBlock(transactions, lastHash, lastBlock.Height+1, 0)
+	if err := chain.Engine.Prepare(chain, newBlock); err != nil {
+		return nil, err
+	}
+	if err := chain.Engine.Seal(context.Background(), chain, newBlock); err != nil {
+		return nil, err
+	}
+	if err := chain.ValidateBlock(newBlock); err != nil {
+		return nil, err
+	}
+	parentWork, err := chain.ChainWork(lastHash)
+	if err != nil {
+		return nil, err
+	}
+	work := new(big.Int).Add(parentWork, BlockWork(newBlock.Bits))
+
+	err = chain.Database.Update(func(batch Batch) error {
+		if err := batch.Put(blockKey(newBlock.Hash), newBlock.Serialize()); err != nil {
+			return err
+		}
 
-			chain.LastHash = newBlock.Hash
+		if err := setWork(batch, newBlock.Hash, work); err != nil {
+			return err
+		}
 
+		if err := connectBlock(batch, newBlock); err != nil {
 			return err
-		})
+		}
+
+		return batch.Put(lastHashKey, newBlock.Hash) //Set the new blocks hash as our latest lastHash
+	})
+	if err != nil {
+		return nil, err
+	}
+	chain.LastHash = newBlock.Hash
+
+	return newBlock, nil
+}
+
+//AddBlock validates a block received from another node and stores it, keeping it even if it is on a side branch.
+//When the block leaves its branch with more cumulative work than the best chain, that branch becomes the best chain
+//and the UTXO set is moved over to it. A block that fails validation is returned as a *BlockError
+func (chain *BlockChain) AddBlock(block *Block) error {
+	if _, err := chain.GetBlock(block.Hash); err == nil {
+		return nil //Already have this block
+	}
+
+	if err := chain.ValidateBlock(block); err != nil {
+		return err
+	}
+
+	work := BlockWork(block.Bits)
+	if len(block.PrevHash) != 0 {
+		parentWork, err := chain.ChainWork(block.PrevHash)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
+		work.Add(work, parentWork)
+	}
 
+	bestWork, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
 		return err
-	})
+	}
+	better := work.Cmp(bestWork) > 0
+	extendsTip := better && bytes.Compare(block.PrevHash, chain.LastHash) == 0
 
+	//A block extending the tip is stored and connected in one write, along with the tip pointer
+	err = chain.Database.Update(func(batch Batch) error {
+		if err := batch.Put(blockKey(block.Hash), block.Serialize()); err != nil {
+			return err
+		}
+		if err := setWork(batch, block.Hash, work); err != nil {
+			return err
+		}
+		if !extendsTip {
+			return nil
+		}
+
+		if err := connectBlock(batch, block); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, block.Hash)
+	})
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	if extendsTip {
+		chain.LastHash = block.Hash
+		return nil
+	}
+	if !better {
+		fmt.Printf("Block %x stored on a side branch\n", block.Hash)
+		return nil
 	}
 
-	return newBlock
+	return chain.reorganize(block)
 }
 
-func (chain *BlockChain) Iterator() *BlockChainIterator {
-	return &BlockChainIterator{chain.LastHash, chain.Database}
+//GetBlock looks up a single block by its hash. It returns an error wrapping ErrBlockNotFound if there is no such block
+func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
+	found, err := getBlock(chain.Database, blockHash)
+	if err == ErrNotFound {
+		return Block{}, fmt.Errorf("%w: %x", ErrBlockNotFound, blockHash)
+	} else if err != nil {
+		return Block{}, err
+	}
+
+	return *found, nil
 }
 
-//Because we start with the BlockChain's LastHash, we're iterating backwards through the blocks (Newest -> Genesis)
+//GetBlockHashes returns the hashes of every block on the chain, from the tip back to the genesis block
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
+	var blocks [][]byte
 
-func (iterator *BlockChainIterator) Next() *Block {
-	var block *Block
+	iterator := chain.Iterator()
 
-	err := iterator.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iterator.CurrentHash)
+	for {
+		block, err := iterator.Next()
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
-		var encodedBlock []byte
-		err = item.Value(func(val []byte) error {
-			encodedBlock = append([]byte{}, val...)
-			return nil
-		})
-		if err != nil {
-			log.Panic(err)
+
+		blocks = append(blocks, block.Hash)
+
+		if len(block.PrevHash) == 0 {
+			break
 		}
+	}
 
-		block = Deserialize(encodedBlock)
+	return blocks, nil
+}
 
-		return err
-	})
-	if err != nil {
-		log.Panic(err)
+func (chain *BlockChain) Iterator() *BlockChainIterator {
+	return &BlockChainIterator{chain.LastHash, chain.Database}
+}
+
+//Because we start with the BlockChain's LastHash, we're iterating backwards through the blocks (Newest -> Genesis)
+
+func (iterator *BlockChainIterator) Next() (*Block, error) {
+	block, err := getBlock(iterator.Database, iterator.CurrentHash)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, iterator.CurrentHash)
+	} else if err != nil {
+		return nil, err
 	}
 
 	iterator.CurrentHash = block.PrevHash //because each block points to its previous block, this sets the next step in the iterator
 
-	return block
+	return block, nil
 }
 
-func DBexists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+//NextHeader steps the iterator like Next, but only hands back the header of the block
+func (iterator *BlockChainIterator) NextHeader() (BlockHeader, error) {
+	block, err := iterator.Next()
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	return block.BlockHeader, nil
+}
+
+func DBexists(path string) bool {
+	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
 		return false
 	}
 
 	return true
 }
 
-func (chain *BlockChain) FindUnspentTransactions() map[string]TxOutputs {
-	UTXO := make(map[string]TxOutputs)
+func blockKey(blockHash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), blockHash...)
+}
+
+func getBlock(db Reader, blockHash []byte) (*Block, error) {
+	encodedBlock, err := db.Get(blockKey(blockHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(encodedBlock)
+}
+
+//FindUnspentTransactions works out the unspent outputs of the best chain from its blocks, by transaction ID and output index
+func (chain *BlockChain) FindUnspentTransactions() (map[string]map[int]UTXO, error) {
+	unspent := make(map[string]map[int]UTXO)
 	spentTXOs := make(map[string][]int)
 
 	iterator := chain.Iterator()
 
 	for {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		for _, transaction := range block.Transactions {
 			txID := hex.EncodeToString(transaction.ID)
@@ -216,9 +519,10 @@ func (chain *BlockChain) FindUnspentTransactions() map[string]TxOutputs {
 						}
 					}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+				if unspent[txID] == nil {
+					unspent[txID] = make(map[int]UTXO)
+				}
+				unspent[txID][outIdx] = UTXO{out, block.Height, transaction.IsCoinbase()}
 			}
 			if transaction.IsCoinbase() == false {
 				for _, in := range transaction.Inputs {
@@ -232,52 +536,76 @@ func (chain *BlockChain) FindUnspentTransactions() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return unspent, nil
 }
 
+//FindTransaction returns an error wrapping ErrTxNotFound if the transaction isn't in a block on the best chain
 func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
-	iterator := chain.Iterator()
+	block, index, err := chain.findTransactionBlock(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
 
-	for {
-		block := iterator.Next()
+	return *block.Transactions[index], nil
+}
 
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-		}
+//GetMerkleProof finds the block holding the transaction, and proves the transaction against that block's merkle root
+func (chain *BlockChain) GetMerkleProof(txID []byte) (*MerkleProof, *Block, error) {
+	block, _, err := chain.findTransactionBlock(txID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	proof, err := block.MerkleProof(txID)
+	return proof, block, err
+}
+
+//findTransactionBlock reads the block the transaction index says the transaction is in, and the transaction's position
+func (chain *BlockChain) findTransactionBlock(ID []byte) (*Block, int, error) {
+	location, err := chain.LocateTransaction(ID)
+	if err != nil {
+		return nil, 0, err
 	}
-	return Transaction{}, errors.New("transaction does not exist")
+
+	block, err := chain.GetBlock(location.BlockHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if location.Index >= len(block.Transactions) || bytes.Compare(block.Transactions[location.Index].ID, ID) != 0 {
+		return nil, 0, fmt.Errorf("%w: transaction index has %x at %x:%d", ErrCorrupt, ID, location.BlockHash, location.Index)
+	}
+
+	return &block, location.Index, nil
 }
 
-func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) {
+func (chain *BlockChain) SignTransaction(tx *Transaction, privateKey ecdsa.PrivateKey) error {
 	previousTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		previousTX, err := chain.FindTransaction(in.ID)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		previousTXs[hex.EncodeToString(previousTX.ID)] = previousTX
 	}
 
-	tx.Sign(privateKey, previousTXs)
+	return tx.Sign(privateKey, previousTXs)
 }
 
-func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
+func (chain *BlockChain) VerifyTransaction(tx *Transaction) (bool, error) {
+	if tx.IsCoinbase() {
+		return true, nil
+	}
+
 	previousTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		previousTX, err := chain.FindTransaction(in.ID)
 		if err != nil {
-			log.Panic(err)
+			return false, err
 		}
 		previousTXs[hex.EncodeToString(previousTX.ID)] = previousTX
 	}
 
-	return tx.Verify(previousTXs)
+	return tx.Verify(previousTXs), nil
 }
@@ -0,0 +1,210 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Tests run on regtest, where blocks need no work and are mined as soon as they are asked for
+func TestMain(m *testing.M) {
+	chaincfg.Active = &chaincfg.RegTest
+	os.Exit(m.Run())
+}
+
+func newWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func address(w *wallet.Wallet) string {
+	return wallet.PubKeyHashToAddress(wallet.PublicKeyHash(w.PublicKey))
+}
+
+//newTestChain creates a proof of work chain in a MemoryStore, on a regtest whose genesis block pays owner
+func newTestChain(t *testing.T, owner *wallet.Wallet) *BlockChain {
+	t.Helper()
+	params := chaincfg.RegTest
+	params.GenesisPubKeyHash = wallet.PublicKeyHash(owner.PublicKey)
+	chaincfg.Active = &params
+	t.Cleanup(func() { chaincfg.Active = &chaincfg.RegTest })
+
+	chain, err := CreateBlockChain(NewMemoryStore(), ConsensusProofOfWork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func getBlockT(t *testing.T, chain *BlockChain, blockHash []byte) *Block {
+	t.Helper()
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+//newTestBlock builds a block on parent with a coinbase paying miner the subsidy, followed by txs. change is called
+//on it after the timestamp and bits are set and before it is mined, so it can be made invalid
+func newTestBlock(t *testing.T, chain *BlockChain, parent *Block, miner *wallet.Wallet, change func(*Block), txs ...*Transaction) *Block {
+	t.Helper()
+	coinbase, err := CoinbaseTx(address(miner), "", BlockSubsidy(parent.Height+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1, 0)
+	if err := (ProofOfWorkEngine{}).Prepare(chain, block); err != nil {
+		t.Fatal(err)
+	}
+	if change != nil {
+		change(block)
+	}
+	if err := block.Mine(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+//mineOn adds a block on parent to the chain and returns it
+func mineOn(t *testing.T, chain *BlockChain, parent *Block, miner *wallet.Wallet, txs ...*Transaction) *Block {
+	t.Helper()
+	block := newTestBlock(t, chain, parent, miner, nil, txs...)
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func send(t *testing.T, chain *BlockChain, from, to *wallet.Wallet, amount int) *Transaction {
+	t.Helper()
+	tx, err := NewTransaction(from, address(to), amount, 0, 0, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func balance(t *testing.T, chain *BlockChain, w *wallet.Wallet) int {
+	t.Helper()
+	outputs, err := UTXOSet{chain}.FindUnspentTransactionOutputs(wallet.PublicKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, out := range outputs {
+		total += out.Value
+	}
+	return total
+}
+
+//checkUTXOSet compares the UTXO set with the unspent outputs worked out from the blocks of the best chain
+func checkUTXOSet(t *testing.T, chain *BlockChain) {
+	t.Helper()
+	unspent, err := chain.FindUnspentTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := 0
+	for _, outs := range unspent {
+		want += len(outs)
+	}
+	got := 0
+	err = chain.Database.Iterate(utxoPrefix, func(key, value []byte) error {
+		got++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("UTXO set has %d outputs, the best chain %d", got, want)
+	}
+}
+
+//The engine is checked before the directory is made, so a chain that can't be created leaves nothing
+func TestInitializeBlockChainLeavesNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		consensus string
+		want      error
+	}{
+		{"unknown consensus", "none", ErrUnknownConsensus},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "chain")
+		if _, err := InitializeBlockChain(path, test.consensus); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: %s was left behind", test.name, path)
+		}
+	}
+}
+
+//Every node builds the same genesis block from the network's parameters, and refuses a chain or a block that starts
+//from another one
+func TestGenesis(t *testing.T) {
+	chaincfg.Active = &chaincfg.MainNet
+	defer func() { chaincfg.Active = &chaincfg.RegTest }()
+
+	genesis, err := Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(genesis.Hash, again.Hash) != 0 {
+		t.Errorf("genesis block is %x, then %x", genesis.Hash, again.Hash)
+	}
+	if genesis.Timestamp != chaincfg.MainNet.GenesisTimestamp || !NewProof(genesis).Validate(chaincfg.MainNet.GenesisBits) {
+		t.Errorf("genesis block %x is not the one mainnet's parameters give", genesis.Hash)
+	}
+
+	store := NewMemoryStore()
+	chain, err := CreateBlockChain(store, ConsensusProofOfWork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(chain.LastHash, genesis.Hash) != 0 {
+		t.Errorf("chain starts from %x, want %x", chain.LastHash, genesis.Hash)
+	}
+
+	chaincfg.Active = &chaincfg.TestNet
+	if _, err := LoadBlockChain(store); !errors.Is(err, ErrWrongGenesis) {
+		t.Errorf("opening a mainnet chain on testnet: got %v, want %v", err, ErrWrongGenesis)
+	}
+	other, err := Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chaincfg.Active = &chaincfg.MainNet
+	if _, err := LoadBlockChain(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(other); !errors.Is(err, ErrWrongGenesis) {
+		t.Errorf("adding testnet's genesis block: got %v, want %v", err, ErrWrongGenesis)
+	}
+}
@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	ConsensusProofOfWork      = "pow"
+	ConsensusProofOfStake     = "pos"
+	ConsensusProofOfAuthority = "poa"
+)
+
+var (
+	consensusKey = []byte("consensus") //Name of the engine the chain was created with
+
+	ErrUnknownConsensus = errors.New("unknown consensus engine")
+	ErrBadSeal          = errors.New("block is not sealed by an eligible signer")
+	ErrNoSigner         = errors.New("a signer wallet is needed to seal blocks")
+)
+
+//ConsensusEngine decides how a new block gets sealed, and how other nodes check that it was.
+//The genesis block is always mined with proof of work, whatever engine the chain runs after it
+type ConsensusEngine interface {
+	Name() string
+
+	//Prepare fills in the consensus fields of a new block's header, like its Bits or Signer
+	Prepare(chain *BlockChain, block *Block) error
+
+	//Seal does whatever makes a prepared block acceptable to other nodes, like mining or signing it, and sets its Hash.
+	//It gives up with ctx.Err() when ctx is cancelled
+	Seal(ctx context.Context, chain *BlockChain, block *Block) error
+
+	//VerifyHeader checks that a block was sealed the way the engine seals blocks. The block's parent has to be known
+	VerifyHeader(chain *BlockChain, block *Block) error
+}
+
+func NewConsensusEngine(name string) (ConsensusEngine, error) {
+	switch name {
+	case ConsensusProofOfWork:
+		return ProofOfWorkEngine{}, nil
+	case ConsensusProofOfStake:
+		return ProofOfStakeEngine{}, nil
+	case ConsensusProofOfAuthority:
+		return ProofOfAuthorityEngine{}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownConsensus, name)
+}
+
+//engineFor picks the engine a block has to be verified with
+func (chain *BlockChain) engineFor(block *Block) ConsensusEngine {
+	if len(block.PrevHash) == 0 {
+		return ProofOfWorkEngine{}
+	}
+	return chain.Engine
+}
+
+//VerifySeal checks the block with the engine it was sealed by
+func (chain *BlockChain) VerifySeal(block *Block) error {
+	return chain.engineFor(block).VerifyHeader(chain, block)
+}
+
+//HeaderHash is the hash of the block's header with its current nonce. It becomes the block's Hash once it is sealed
+func (b *Block) HeaderHash() []byte {
+	hash := sha256.Sum256(NewProof(b).InitializeData(b.Nonce))
+	return hash[:]
+}
+
+//signBlock signs the block's hash with the wallet's key, for engines where blocks are signed rather than mined
+func signBlock(block *Block, w *wallet.Wallet) error {
+	r, s, err := ecdsa.Sign(rand.Reader, &w.PrivateKey, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	block.Signature = signature
+
+	return nil
+}
+
+//verifyBlockSignature checks that the block's Signer signed its hash
+func verifyBlockSignature(block *Block) bool {
+	if len(block.Signature) != 64 || len(block.Signer) == 0 {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(block.Signature[:32])
+	s := new(big.Int).SetBytes(block.Signature[32:])
+
+	publicKey, err := wallet.ParsePublicKey(block.Signer)
+	if err != nil {
+		return false
+	}
+	return ecdsa.Verify(&publicKey, block.Hash, r, s)
+}
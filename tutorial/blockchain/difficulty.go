@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	MedianTimeBlocks   = 11               //Number of blocks whose median timestamp a mined block's timestamp has to be after
+	MaxFutureBlockTime = 20 * time.Second //How far ahead of our clock a block's timestamp can be
+)
+
+//NextDifficulty works out the bits the block after prev has to be mined at.
+//Every RetargetInterval blocks, the time it took to mine the last interval is compared to the time it should have taken.
+//As each bit doubles the work, the difficulty moves by log2 of that ratio, limited to MaxRetargetStep bits either way.
+//The intervals, times and limits are the active network's
+func (chain *BlockChain) NextDifficulty(prev *Block) (int, error) {
+	params := chaincfg.Active
+	height := prev.Height + 1
+	if params.NoRetargeting || height%params.RetargetInterval != 0 {
+		return prev.Bits, nil
+	}
+
+	first := prev
+	for i := 1; i < params.RetargetInterval; i++ {
+		block, err := chain.GetBlock(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = &block
+	}
+
+	expected := float64(params.RetargetInterval * params.TargetBlockTime)
+	actual := float64(prev.Timestamp - first.Timestamp)
+	if actual < 1 {
+		actual = 1
+	}
+
+	step := int(math.Round(math.Log2(expected / actual)))
+	if step > params.MaxRetargetStep {
+		step = params.MaxRetargetStep
+	} else if step < -params.MaxRetargetStep {
+		step = -params.MaxRetargetStep
+	}
+
+	bits := prev.Bits + step
+	if bits < params.MinDifficulty {
+		bits = params.MinDifficulty
+	} else if bits > params.MaxDifficulty {
+		bits = params.MaxDifficulty
+	}
+
+	return bits, nil
+}
+
+//ExpectedDifficulty returns the bits a block should have been mined at, going by the blocks before it
+func (chain *BlockChain) ExpectedDifficulty(block *Block) (int, error) {
+	if len(block.PrevHash) == 0 {
+		return chaincfg.Active.GenesisBits, nil
+	}
+
+	prev, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return chain.NextDifficulty(&prev)
+}
+
+//MedianTimePast is the median timestamp of the MedianTimeBlocks blocks up to and including block, or of every block
+//back to the genesis block if there aren't as many
+func (chain *BlockChain) MedianTimePast(block *Block) (int64, error) {
+	timestamps := []int64{block.Timestamp}
+	for current := block; len(timestamps) < MedianTimeBlocks && len(current.PrevHash) != 0; {
+		previous, err := chain.GetBlock(current.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		current = &previous
+		timestamps = append(timestamps, current.Timestamp)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+//checkBlockTime checks that a mined block's timestamp is after the median time past of its parent, and no more than
+//MaxFutureBlockTime ahead of our clock. Otherwise miners could date their blocks to move the retarget their way
+func (chain *BlockChain) checkBlockTime(block *Block) error {
+	if len(block.PrevHash) == 0 {
+		return nil
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return blockError(block, ErrUnknownParent, "%x", block.PrevHash)
+	}
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= medianTime {
+		return blockError(block, ErrBadTimestamp, "%d is not after the median time past %d", block.Timestamp, medianTime)
+	}
+	if now := time.Now(); block.Timestamp > now.Add(MaxFutureBlockTime).Unix() {
+		return blockError(block, ErrBadTimestamp, "%d seconds ahead of our clock", block.Timestamp-now.Unix())
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"errors"
+	"testing"
+	"time"
+)
+
+//storeHeaders stores a line of blocks with the given timestamps and bits, from height 0 up, without checking them
+func storeHeaders(t *testing.T, chain *BlockChain, bits int, timestamps ...int64) []*Block {
+	t.Helper()
+	var blocks []*Block
+	var prevHash []byte
+	for height, timestamp := range timestamps {
+		block := &Block{BlockHeader: BlockHeader{Version: BlockVersion, Height: height, Timestamp: timestamp,
+			PrevHash: prevHash, Bits: bits}}
+		block.Hash = make([]byte, 32)
+		block.Hash[0], block.Hash[1] = byte(height+1), byte(bits)
+		if err := chain.Database.Put(blockKey(block.Hash), block.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		prevHash = block.Hash
+	}
+	return blocks
+}
+
+//On mainnet a retarget every 10 blocks aims for 100 seconds an interval, moving by at most 2 bits
+func TestNextDifficulty(t *testing.T) {
+	chaincfg.Active = &chaincfg.MainNet
+	defer func() { chaincfg.Active = &chaincfg.RegTest }()
+
+	tests := []struct {
+		name   string
+		height int   //Of the block before the one whose bits are worked out
+		bits   int   //Of the blocks before it
+		actual int64 //Seconds between the first and last block of the interval
+		want   int
+	}{
+		{"not a retarget height", 4, 12, 1, 12},
+		{"on time", 9, 12, 100, 12},
+		{"twice as fast", 9, 12, 50, 13},
+		{"four times as fast", 9, 12, 25, 14},
+		{"much faster is clamped", 9, 12, 1, 14},
+		{"no time at all is clamped", 9, 12, 0, 14},
+		{"twice as slow", 9, 12, 200, 11},
+		{"much slower is clamped", 9, 12, 10000, 10},
+		{"not below the minimum", 9, 2, 10000, 1},
+		{"not above the maximum", 9, 239, 1, 240},
+	}
+
+	for _, test := range tests {
+		chain := &BlockChain{Database: NewMemoryStore()}
+		timestamps := make([]int64, test.height+1)
+		for i := range timestamps {
+			timestamps[i] = 1000
+		}
+		timestamps[test.height] += test.actual
+		blocks := storeHeaders(t, chain, test.bits, timestamps...)
+
+		got, err := chain.NextDifficulty(blocks[test.height])
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %d bits, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+//A block has to be dated after the median of the 11 blocks before it, and not too far ahead of our clock
+func TestCheckBlockTime(t *testing.T) {
+	chaincfg.Active = &chaincfg.MainNet
+	defer func() { chaincfg.Active = &chaincfg.RegTest }()
+
+	chain := &BlockChain{Database: NewMemoryStore()}
+	//The last 11 have the median 1050, out of order like miners' clocks leave them
+	blocks := storeHeaders(t, chain, 12, 5000, 1000, 1100, 1010, 1090, 1020, 1080, 1030, 1070, 1040, 1060, 1050)
+	parent := blocks[len(blocks)-1]
+
+	if median, err := chain.MedianTimePast(blocks[2]); err != nil || median != 1100 {
+		t.Errorf("median of the first 3 blocks is %d, %v, want 1100", median, err)
+	}
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		timestamp int64
+		want      error
+	}{
+		{"at the median time past", 1050, ErrBadTimestamp},
+		{"before the median time past", 1000, ErrBadTimestamp},
+		{"after the median time past, before the parent", 1051, nil},
+		{"now", now, nil},
+		{"a little ahead of our clock", now + 10, nil},
+		{"too far ahead of our clock", now + int64(MaxFutureBlockTime/time.Second) + 60, ErrBadTimestamp},
+	}
+
+	for _, test := range tests {
+		block := &Block{BlockHeader: BlockHeader{Height: parent.Height + 1, Timestamp: test.timestamp,
+			PrevHash: parent.Hash, Bits: 12}, Hash: make([]byte, 32)}
+		if err := chain.checkBlockTime(block); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
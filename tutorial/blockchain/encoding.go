@@ -0,0 +1,387 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//Blocks, transactions and UTXO entries are kept on disk, sent between nodes and hashed in a binary encoding that
+//doesn't depend on Go, laid out in blockchain.md:
+//	- Every record starts with a byte giving the version of the encoding it is in, EncodingVersion
+//	- Counts and lengths are unsigned varints, every other integer a zig-zag signed varint, as in encoding/binary
+//	- Byte slices are their length followed by the bytes
+//	- Booleans are a single byte, 0 or 1
+//Fields are written in the order they are declared in, nothing is left out
+const (
+	EncodingVersion = 1
+)
+
+var (
+	errTruncated = errors.New("data ends early")
+)
+
+//Encoder writes a record in the binary encoding. The network package writes its messages with it too
+type Encoder struct {
+	buffer bytes.Buffer
+}
+
+//PutVersion writes the byte every record starts with
+func (e *Encoder) PutVersion() {
+	e.buffer.WriteByte(EncodingVersion)
+}
+
+func (e *Encoder) PutUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buffer.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (e *Encoder) PutVarint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buffer.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *Encoder) PutInt(v int) {
+	e.PutVarint(int64(v))
+}
+
+func (e *Encoder) PutBytes(b []byte) {
+	e.PutUvarint(uint64(len(b)))
+	e.buffer.Write(b)
+}
+
+func (e *Encoder) PutBool(b bool) {
+	if b {
+		e.buffer.WriteByte(1)
+	} else {
+		e.buffer.WriteByte(0)
+	}
+}
+
+//Bytes returns what has been written so far
+func (e *Encoder) Bytes() []byte {
+	return e.buffer.Bytes()
+}
+
+//Decoder reads what Encoder writes. The first error sticks, and every read after it returns zero values
+type Decoder struct {
+	data []byte
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data}
+}
+
+func (d *Decoder) Uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *Decoder) Varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *Decoder) Int() int {
+	return int(d.Varint())
+}
+
+//Count reads how many items follow. Every item takes at least a byte, which stops a bad count from allocating more
+//than the data could hold
+func (d *Decoder) Count() int {
+	n := d.Uvarint()
+	if n > uint64(len(d.data)) {
+		d.Fail(errTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+//Bytes reads a byte slice. An empty one comes back as nil, the way gob gave them back
+func (d *Decoder) Bytes() []byte {
+	n := d.Count()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	b := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *Decoder) Bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.data) == 0 {
+		d.err = errTruncated
+		return false
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	if b > 1 {
+		d.err = fmt.Errorf("boolean byte %d", b)
+	}
+	return b == 1
+}
+
+//Version reads the byte every record starts with
+func (d *Decoder) Version() {
+	if d.err != nil {
+		return
+	}
+	if len(d.data) == 0 {
+		d.err = errTruncated
+		return
+	}
+	if d.data[0] != EncodingVersion {
+		d.err = fmt.Errorf("unknown encoding version %d", d.data[0])
+		return
+	}
+	d.data = d.data[1:]
+}
+
+//Fail stops the decode with err, unless it has already failed
+func (d *Decoder) Fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+//Done returns the first error of the decode. Bytes left over are an error too, a record is decoded exactly
+func (d *Decoder) Done() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d bytes left over", len(d.data))
+	}
+	return d.err
+}
+
+//Finish is Done, with the error returned as ErrCorrupt for what was being decoded
+func (d *Decoder) Finish(what string) error {
+	if err := d.Done(); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorrupt, what, err)
+	}
+	return nil
+}
+
+func encodeOutput(e *Encoder, out TxOutput) {
+	e.PutInt(out.Value)
+	e.PutBytes(out.PubKeyHash)
+}
+
+func decodeOutput(d *Decoder) TxOutput {
+	return TxOutput{Value: d.Int(), PubKeyHash: d.Bytes()}
+}
+
+func encodeTransaction(e *Encoder, tx *Transaction) {
+	e.PutVersion()
+	e.PutBytes(tx.ID)
+
+	e.PutUvarint(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.PutBytes(in.ID)
+		e.PutInt(in.Out)
+		e.PutBytes(in.Signature)
+		e.PutBytes(in.PubKey)
+	}
+
+	e.PutUvarint(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		encodeOutput(e, out)
+	}
+}
+
+func decodeTransaction(d *Decoder) Transaction {
+	var tx Transaction
+
+	d.Version()
+	tx.ID = d.Bytes()
+
+	for i, inputs := 0, d.Count(); i < inputs; i++ {
+		tx.Inputs = append(tx.Inputs, TxInput{ID: d.Bytes(), Out: d.Int(), Signature: d.Bytes(), PubKey: d.Bytes()})
+	}
+	for i, outputs := 0, d.Count(); i < outputs; i++ {
+		tx.Outputs = append(tx.Outputs, decodeOutput(d))
+	}
+
+	return tx
+}
+
+func encodeBlock(e *Encoder, b *Block) {
+	e.PutVersion()
+
+	e.PutInt(b.Version)
+	e.PutInt(b.Height)
+	e.PutVarint(b.Timestamp)
+	e.PutBytes(b.PrevHash)
+	e.PutBytes(b.MerkleRoot)
+	e.PutInt(b.Bits)
+	e.PutBytes(b.Signer)
+	e.PutBytes(b.Vote)
+	e.PutBool(b.VoteAdd)
+	e.PutVarint(int64(b.Nonce))
+
+	e.PutBytes(b.Hash)
+	e.PutBytes(b.Signature)
+
+	//Each transaction as a byte slice of its own, so it can be taken out of the block without decoding it
+	e.PutUvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.PutBytes(tx.Serialize())
+	}
+}
+
+func decodeBlock(d *Decoder) *Block {
+	var b Block
+
+	d.Version()
+	b.Version = d.Int()
+	b.Height = d.Int()
+	b.Timestamp = d.Varint()
+	b.PrevHash = d.Bytes()
+	b.MerkleRoot = d.Bytes()
+	b.Bits = d.Int()
+	b.Signer = d.Bytes()
+	b.Vote = d.Bytes()
+	b.VoteAdd = d.Bool()
+	nonce := d.Varint()
+	if nonce < 0 || nonce > MaxNonce {
+		d.Fail(fmt.Errorf("nonce %d is out of range", nonce))
+	}
+	b.Nonce = uint32(nonce)
+
+	b.Hash = d.Bytes()
+	b.Signature = d.Bytes()
+
+	for i, txs := 0, d.Count(); i < txs; i++ {
+		txData := NewDecoder(d.Bytes())
+		tx := decodeTransaction(txData)
+		if err := txData.Done(); err != nil {
+			d.Fail(fmt.Errorf("transaction %d: %s", i, err))
+		}
+		b.Transactions = append(b.Transactions, &tx)
+	}
+
+	return &b
+}
+
+func encodeUTXO(e *Encoder, utxo UTXO) {
+	e.PutVersion()
+	encodeOutput(e, utxo.Output)
+	e.PutInt(utxo.Height)
+	e.PutBool(utxo.Coinbase)
+}
+
+func decodeUTXO(d *Decoder) UTXO {
+	d.Version()
+	return UTXO{Output: decodeOutput(d), Height: d.Int(), Coinbase: d.Bool()}
+}
+
+func encodeUndo(e *Encoder, undo BlockUndo) {
+	e.PutVersion()
+
+	e.PutUvarint(uint64(len(undo.Spent)))
+	for _, spent := range undo.Spent {
+		e.PutBytes(spent.TxID)
+		e.PutInt(spent.Out)
+		e.PutBytes(spent.UTXO.Serialize())
+	}
+}
+
+func decodeUndo(d *Decoder) BlockUndo {
+	var undo BlockUndo
+
+	d.Version()
+	for i, spent := 0, d.Count(); i < spent; i++ {
+		txID, out := d.Bytes(), d.Int()
+
+		utxoData := NewDecoder(d.Bytes())
+		utxo := decodeUTXO(utxoData)
+		if err := utxoData.Done(); err != nil {
+			d.Fail(fmt.Errorf("spent output %d: %s", i, err))
+		}
+
+		undo.Spent = append(undo.Spent, SpentOutput{txID, out, utxo})
+	}
+
+	return undo
+}
+
+func encodeTxLocation(e *Encoder, location TxLocation) {
+	e.PutVersion()
+	e.PutBytes(location.BlockHash)
+	e.PutInt(location.Index)
+}
+
+func decodeTxLocation(d *Decoder) TxLocation {
+	d.Version()
+	return TxLocation{BlockHash: d.Bytes(), Index: d.Int()}
+}
+
+func encodeOutputs(e *Encoder, outs TxOutputs) {
+	e.PutVersion()
+
+	e.PutUvarint(uint64(len(outs.Outputs)))
+	for _, out := range outs.Outputs {
+		encodeOutput(e, out)
+	}
+}
+
+func decodeOutputs(d *Decoder) TxOutputs {
+	var outs TxOutputs
+
+	d.Version()
+	for i, outputs := 0, d.Count(); i < outputs; i++ {
+		outs.Outputs = append(outs.Outputs, decodeOutput(d))
+	}
+
+	return outs
+}
+
+//encodeProposals writes the candidates ordered by public key hash, so the same proposals are always written the same
+func encodeProposals(e *Encoder, proposals map[string]bool) {
+	candidates := make([]string, 0, len(proposals))
+	for candidate := range proposals {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
+
+	e.PutVersion()
+	e.PutUvarint(uint64(len(candidates)))
+	for _, candidate := range candidates {
+		pubKeyHash, _ := hex.DecodeString(candidate)
+		e.PutBytes(pubKeyHash)
+		e.PutBool(proposals[candidate])
+	}
+}
+
+func decodeProposals(d *Decoder) map[string]bool {
+	proposals := make(map[string]bool)
+
+	d.Version()
+	for i, candidates := 0, d.Count(); i < candidates; i++ {
+		candidate := hex.EncodeToString(d.Bytes())
+		proposals[candidate] = d.Bool()
+	}
+
+	return proposals
+}
@@ -0,0 +1,96 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+//The records below are written out byte by byte from the layout in blockchain.md, so a change to the encoding that
+//would split the network, or leave databases unreadable, shows up here
+
+var goldenTx = Transaction{
+	ID:      []byte{0xaa, 0xbb},
+	Inputs:  []TxInput{{ID: []byte{0x01}, Out: -1, Signature: []byte{0x02, 0x03}, PubKey: []byte{0x04}}},
+	Outputs: []TxOutput{{Value: 100, PubKeyHash: []byte{0x05, 0x06}}},
+}
+
+const goldenTxHex = "01" + //version
+	"02aabb" + //ID
+	"01" + "0101" + "01" + "020203" + "0104" + //one input: ID, Out -1, Signature, PubKey
+	"01" + "c801" + "020506" //one output: Value 100, PubKeyHash
+
+var goldenUTXO = UTXO{Output: TxOutput{Value: 100, PubKeyHash: []byte{0x05, 0x06}}, Height: 3, Coinbase: true}
+
+const goldenUTXOHex = "01" + "c801" + "020506" + "06" + "01"
+
+func TestEncodingGolden(t *testing.T) {
+	block := &Block{
+		BlockHeader:  BlockHeader{Version: 2, Height: 1, Timestamp: 1, PrevHash: []byte{0x0a}, MerkleRoot: []byte{0x0b}, Nonce: 5},
+		Hash:         []byte{0x0c},
+		Transactions: []*Transaction{&goldenTx},
+	}
+	undo := BlockUndo{Spent: []SpentOutput{{TxID: []byte{0xaa}, Out: 1, UTXO: goldenUTXO}}}
+
+	tests := []struct {
+		name    string
+		encoded []byte
+		want    string
+		decode  func(data []byte) (interface{}, error)
+		value   interface{}
+	}{
+		{
+			"transaction", goldenTx.Serialize(), goldenTxHex,
+			func(data []byte) (interface{}, error) { return DeserializeTransaction(data) },
+			goldenTx,
+		},
+		{
+			"utxo", goldenUTXO.Serialize(), goldenUTXOHex,
+			func(data []byte) (interface{}, error) { return DeserializeUTXO(data) },
+			goldenUTXO,
+		},
+		{
+			"block", block.Serialize(),
+			"01" + //version
+				"04" + "02" + "02" + "010a" + "010b" + //header Version 2, Height 1, Timestamp 1, PrevHash, MerkleRoot
+				"00" + "00" + "00" + "00" + "0a" + //Bits 0, no Signer, no Vote, VoteAdd false, Nonce 5
+				"010c" + "00" + //Hash, no Signature
+				"01" + "13" + goldenTxHex, //one transaction, as a byte string of 19 bytes
+			func(data []byte) (interface{}, error) { return Deserialize(data) },
+			block,
+		},
+		{
+			"undo", undo.Serialize(),
+			"01" + "01" + "01aa" + "02" + "08" + goldenUTXOHex, //one spent output: TxID, Out 1, the UTXO as a byte string
+			func(data []byte) (interface{}, error) { return DeserializeUndo(data) },
+			undo,
+		},
+		{
+			"tx location", TxLocation{[]byte{0x0c}, 2}.Serialize(), "01" + "010c" + "04",
+			func(data []byte) (interface{}, error) { return DeserializeTxLocation(data) },
+			TxLocation{[]byte{0x0c}, 2},
+		},
+		{
+			"proposals", serializeProposals(map[string]bool{"03": false, "0102": true}),
+			"01" + "02" + "020102" + "01" + "0103" + "00", //two candidates in order: 0102 to add, 03 to remove
+			func(data []byte) (interface{}, error) { return deserializeProposals(data) },
+			map[string]bool{"03": false, "0102": true},
+		},
+	}
+
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.encoded); got != test.want {
+			t.Errorf("%s encodes to %s, want %s", test.name, got, test.want)
+		}
+
+		want, _ := hex.DecodeString(test.want)
+		decoded, err := test.decode(want)
+		if err != nil {
+			t.Errorf("decoding %s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.value) {
+			t.Errorf("%s decodes to %+v, want %+v", test.name, decoded, test.value)
+		}
+	}
+}
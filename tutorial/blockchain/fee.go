@@ -0,0 +1,22 @@
+package blockchain
+
+const (
+	txBaseSize  = 100 //Serialized size of a transaction with a payment and a change output, before any inputs
+	txInputSize = 170 //Serialized size each signed input adds
+)
+
+//EstimateTxSize is a slight overestimate of the size of a signed transaction with the given number of inputs
+func EstimateTxSize(inputs int) int {
+	return txBaseSize + inputs*txInputSize
+}
+
+//FeeForSize works out the fee for a transaction of size bytes at feeRate per 1000 bytes, rounding up
+func FeeForSize(size, feeRate int) int {
+	return (size*feeRate + 999) / 1000
+}
+
+//Fee is what a transaction pays to be mined, its inputs minus its outputs. The transaction has to be valid against
+//the UTXO set
+func (u UTXOSet) Fee(tx *Transaction) (int, error) {
+	return u.BlockChain.checkTransactionInputs(tx, nil, false)
+}
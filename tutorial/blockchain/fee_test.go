@@ -0,0 +1,102 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"errors"
+	"testing"
+)
+
+//newPayer gives a new wallet outputs worth 60, 30, 5 and 1
+func newPayer(t *testing.T) (*BlockChain, *wallet.Wallet) {
+	t.Helper()
+	owner, payer := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	tip := getBlockT(t, chain, chain.LastHash)
+	for _, value := range []int{60, 30, 5, 1} {
+		tip = mineOn(t, chain, tip, owner, send(t, chain, owner, payer, value))
+	}
+	return chain, payer
+}
+
+//Outputs are picked largest first until they cover the amount and the fee for the inputs picked so far, skipping
+//those that cost more to spend than they are worth
+func TestFindSpendableOutputs(t *testing.T) {
+	chain, payer := newPayer(t)
+
+	tests := []struct {
+		name        string
+		amount      int
+		feeRate     int
+		accumulated int
+		fee         int
+		inputs      int
+	}{
+		{"one output covers it", 50, 0, 60, 0, 1},
+		{"two outputs", 70, 0, 90, 0, 2},
+		{"every output", 96, 0, 96, 0, 4},
+		{"not enough", 97, 0, 96, 0, 4},
+		//At 100 per 1000 bytes the transaction pays 10 and each input 17 more, so the outputs of 5 and 1 are skipped
+		{"fee for one input", 30, 100, 60, 27, 1},
+		{"fee pulls in a second input", 40, 100, 90, 44, 2},
+		{"dust is skipped", 80, 100, 90, 44, 2},
+	}
+
+	for _, test := range tests {
+		accumulated, fee, outputs, err := UTXOSet{chain}.FindSpendableOutputs(wallet.PublicKeyHash(payer.PublicKey), test.amount, test.feeRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs := 0
+		for _, outs := range outputs {
+			inputs += len(outs)
+		}
+		if accumulated != test.accumulated || fee != test.fee || inputs != test.inputs {
+			t.Errorf("%s: got %d with a fee of %d from %d outputs, want %d with %d from %d", test.name,
+				accumulated, fee, inputs, test.accumulated, test.fee, test.inputs)
+		}
+	}
+}
+
+//A transaction leaves the fixed fee plus the fee for its size to the miner, and is refused if the wallet can't
+//cover both
+func TestNewTransactionFee(t *testing.T) {
+	chain, payer := newPayer(t)
+	to := address(newWallet(t))
+
+	tests := []struct {
+		name    string
+		amount  int
+		fee     int
+		feeRate int
+		want    int //Fee the transaction pays
+		err     error
+	}{
+		{"no fee", 30, 0, 0, 0, nil},
+		{"fixed fee", 30, 5, 0, 5, nil},
+		{"fee for the size", 30, 0, 100, 27, nil},
+		{"both, which takes a second input", 30, 5, 100, 5 + 44, nil},
+		{"exactly everything", 90, 6, 0, 6, nil},
+		{"one more than everything", 90, 7, 0, 0, ErrNotEnoughFunds},
+		{"fee for the size is too much", 80, 0, 100, 0, ErrNotEnoughFunds},
+	}
+
+	for _, test := range tests {
+		tx, err := NewTransaction(payer, to, test.amount, test.fee, test.feeRate, &UTXOSet{chain})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		fee, err := UTXOSet{chain}.Fee(tx)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if fee != test.want || tx.Outputs[0].Value != test.amount {
+			t.Errorf("%s: pays %d with a fee of %d, want %d with %d", test.name, tx.Outputs[0].Value, fee,
+				test.amount, test.want)
+		}
+	}
+}
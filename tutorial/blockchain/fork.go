@@ -0,0 +1,362 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	workPrefix = []byte("work-")
+
+	ErrGenesisBlock = errors.New("the genesis block is fixed")
+)
+
+//BlockWork is the number of hashes it takes on average to mine a block at the given bits
+func BlockWork(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits))
+}
+
+//ChainWork returns the total work of the branch ending at blockHash, from the genesis block up to and including that block.
+//Blocks stored before work was tracked get their records filled in on the way
+func (chain *BlockChain) ChainWork(blockHash []byte) (*big.Int, error) {
+	var work *big.Int
+	var missing []*Block
+
+	hash := blockHash
+	for {
+		found, err := getWork(chain.Database, hash)
+		if err == nil {
+			work = found
+			break
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+
+		block, err := getBlock(chain.Database, hash)
+		if err == ErrNotFound {
+			return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+		} else if err != nil {
+			return nil, err
+		}
+		missing = append(missing, block)
+
+		if len(block.PrevHash) == 0 {
+			work = big.NewInt(0)
+			break
+		}
+		hash = block.PrevHash
+	}
+
+	if len(missing) == 0 {
+		return work, nil
+	}
+
+	err := chain.Database.Update(func(batch Batch) error {
+		for i := len(missing) - 1; i >= 0; i-- {
+			work = new(big.Int).Add(work, BlockWork(missing[i].Bits))
+			if err := setWork(batch, missing[i].Hash, work); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return work, nil
+}
+
+//reorganize switches the best chain over to the branch ending at newTip.
+//The UTXO set is rolled back to the fork with the undo data of the old branch, then rolled forward along the new branch.
+//Each block of the new branch is checked against the UTXO set before it is connected. If one fails, it is marked
+//invalid and the old branch is put back. The old branch is also put back if one of its blocks can't be disconnected
+func (chain *BlockChain) reorganize(newTip *Block) error {
+	oldTip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+
+	detach, attach, err := chain.forkBranches(&oldTip, newTip)
+	if err != nil {
+		return err
+	}
+
+	for _, block := range attach {
+		invalid, err := chain.IsInvalid(block.Hash)
+		if err != nil {
+			return err
+		}
+		if invalid {
+			return blockError(newTip, ErrInvalidatedBlock, "builds on invalidated block %x", block.Hash)
+		}
+	}
+
+	//A block that can't be disconnected, for example because its undo data is gone, keeps the old branch.
+	//The new one can't be switched to without checking its blocks against the UTXO set at the fork
+	for i, block := range detach {
+		if err := chain.disconnect(block); err != nil {
+			if restoreErr := chain.restoreBranch(nil, detach[:i]); restoreErr != nil {
+				return fmt.Errorf("putting back the old branch after %s: %w", err, restoreErr)
+			}
+			return fmt.Errorf("keeping the old branch, disconnecting block %x failed: %w", block.Hash, err)
+		}
+	}
+
+	for i, block := range attach {
+		if invalid := chain.checkBlockInputs(block); invalid != nil {
+			if err := chain.markInvalid(block.Hash); err != nil {
+				return err
+			}
+			if err := chain.restoreBranch(attach[:i], detach); err != nil {
+				return fmt.Errorf("putting back the old branch after %s: %w", invalid, err)
+			}
+
+			return invalid
+		}
+
+		if err := chain.connect(block); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Reorganized chain to %x: %d blocks detached, %d blocks attached\n", newTip.Hash, len(detach), len(attach))
+
+	return nil
+}
+
+//restoreBranch undoes a reorganization that failed part of the way through. The attached blocks are disconnected from
+//the tip down, then the detached blocks are connected again from the fork up
+func (chain *BlockChain) restoreBranch(attached, detached []*Block) error {
+	for j := len(attached) - 1; j >= 0; j-- {
+		if err := chain.disconnect(attached[j]); err != nil {
+			return err
+		}
+	}
+	for j := len(detached) - 1; j >= 0; j-- {
+		if err := chain.connect(detached[j]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//RewindTo disconnects blocks from the tip of the best chain until the tip is at the given height
+func (chain *BlockChain) RewindTo(height int) error {
+	if height < 0 {
+		return fmt.Errorf("%w: cannot rewind past it", ErrGenesisBlock)
+	}
+
+	for {
+		tip, err := chain.GetBlock(chain.LastHash)
+		if err != nil {
+			return err
+		}
+		if tip.Height <= height {
+			return nil
+		}
+
+		if err := chain.disconnect(&tip); err != nil {
+			return err
+		}
+	}
+}
+
+//InvalidateBlock marks a block as invalid so it, and every block built on it, is refused from then on.
+//If the block is on the best chain, the chain is rewound to the block before it
+func (chain *BlockChain) InvalidateBlock(blockHash []byte) error {
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return err
+	}
+	if len(block.PrevHash) == 0 {
+		return fmt.Errorf("%w: cannot invalidate it", ErrGenesisBlock)
+	}
+
+	onBestChain, err := chain.onBestChain(&block)
+	if err != nil {
+		return err
+	}
+	if onBestChain {
+		if err := chain.RewindTo(block.Height - 1); err != nil {
+			return err
+		}
+	}
+
+	return chain.markInvalid(blockHash)
+}
+
+func (chain *BlockChain) markInvalid(blockHash []byte) error {
+	return chain.Database.Put(invalidKey(blockHash), []byte{})
+}
+
+//IsInvalid reports whether a block was marked invalid by InvalidateBlock
+func (chain *BlockChain) IsInvalid(blockHash []byte) (bool, error) {
+	_, err := chain.Database.Get(invalidKey(blockHash))
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (chain *BlockChain) onBestChain(block *Block) (bool, error) {
+	hash, err := chain.GetBlockHash(block.Height)
+	if errors.Is(err, ErrBlockNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return bytes.Compare(hash, block.Hash) == 0, nil
+}
+
+//forkBranches walks both tips back to the block they have in common.
+//detach holds the blocks only on the old branch from its tip down, attach the blocks only on the new branch from the fork up
+func (chain *BlockChain) forkBranches(oldTip, newTip *Block) (detach []*Block, attach []*Block, err error) {
+	parent := func(block *Block) *Block {
+		if err != nil {
+			return block
+		}
+		prev, found := chain.GetBlock(block.PrevHash)
+		if found != nil {
+			err = found
+			return block
+		}
+		return &prev
+	}
+
+	oldBranch, newBranch := oldTip, newTip
+	for err == nil && oldBranch.Height > newBranch.Height {
+		detach = append(detach, oldBranch)
+		oldBranch = parent(oldBranch)
+	}
+	for err == nil && newBranch.Height > oldBranch.Height {
+		attach = append([]*Block{newBranch}, attach...)
+		newBranch = parent(newBranch)
+	}
+	for err == nil && bytes.Compare(oldBranch.Hash, newBranch.Hash) != 0 {
+		detach = append(detach, oldBranch)
+		attach = append([]*Block{newBranch}, attach...)
+		oldBranch = parent(oldBranch)
+		newBranch = parent(newBranch)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return detach, attach, nil
+}
+
+//connect makes a block that builds on the tip of the best chain its new tip. The tip moves in the same write as the
+//UTXO set and the indexes, so a crash can't leave one without the other
+func (chain *BlockChain) connect(block *Block) error {
+	err := chain.Database.Update(func(batch Batch) error {
+		if err := connectBlock(batch, block); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.LastHash = block.Hash
+	return nil
+}
+
+//disconnect takes the block at the tip of the best chain off it, in a single write like connect
+func (chain *BlockChain) disconnect(block *Block) error {
+	err := chain.Database.Update(func(batch Batch) error {
+		if err := disconnectBlock(batch, block); err != nil {
+			return err
+		}
+		return batch.Put(lastHashKey, block.PrevHash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.LastHash = block.PrevHash
+	return nil
+}
+
+//repairUTXOSet brings the UTXO set and the indexes back to the tip of the best chain. They are moved from the block
+//they were left at with the undo data of the blocks in between, or rebuilt from the blocks if that isn't possible
+func (chain *BlockChain) repairUTXOSet() error {
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+
+	utxoTip, err := chain.Database.Get(utxoTipKey)
+	if err == ErrNotFound {
+		return chain.rebuildUTXOSet() //Chains from before the UTXO set's tip was kept
+	} else if err != nil {
+		return err
+	}
+
+	if err := chain.moveUTXOSet(utxoTip, &tip); err != nil {
+		fmt.Printf("%s, rebuilding the UTXO set and indexes instead\n", err)
+		return chain.rebuildUTXOSet()
+	}
+
+	return nil
+}
+
+//moveUTXOSet moves the UTXO set and the indexes from the block they are at over to the tip, leaving the tip where it is
+func (chain *BlockChain) moveUTXOSet(from []byte, tip *Block) error {
+	block, err := chain.GetBlock(from)
+	if err != nil {
+		return err
+	}
+
+	detach, attach, err := chain.forkBranches(&block, tip)
+	if err != nil {
+		return err
+	}
+
+	UTXOSet := UTXOSet{chain}
+	for _, block := range detach {
+		if err := UTXOSet.Disconnect(block); err != nil {
+			return err
+		}
+	}
+	for _, block := range attach {
+		if err := UTXOSet.Update(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//rebuildUTXOSet builds the UTXO set and the indexes that follow the best chain again from its blocks
+func (chain *BlockChain) rebuildUTXOSet() error {
+	if _, err := chain.ReindexTransactions(); err != nil {
+		return err
+	}
+	if err := chain.ReindexHeights(); err != nil {
+		return err
+	}
+
+	return UTXOSet{chain}.Reindex()
+}
+
+func getWork(db Reader, blockHash []byte) (*big.Int, error) {
+	value, err := db.Get(append(append([]byte{}, workPrefix...), blockHash...))
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(value), nil
+}
+
+func setWork(batch Batch, blockHash []byte, work *big.Int) error {
+	return batch.Put(append(append([]byte{}, workPrefix...), blockHash...), work.Bytes())
+}
@@ -0,0 +1,134 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReorganize(t *testing.T) {
+	tests := []struct {
+		name     string
+		oldLen   int
+		newLen   int
+		spend    bool //Whether the first block of the old branch pays 30 from the owner to its miner
+		switched bool
+	}{
+		{"longer branch wins", 2, 3, false, true},
+		{"equal work keeps the tip", 2, 2, false, false},
+		{"shorter branch is kept on the side", 3, 1, false, false},
+		{"spend on the old branch is undone", 2, 3, true, true},
+		{"spend is kept when the old branch stays", 2, 2, true, false},
+	}
+
+	for _, test := range tests {
+		owner, oldMiner, newMiner := newWallet(t), newWallet(t), newWallet(t)
+		chain := newTestChain(t, owner)
+		genesis := getBlockT(t, chain, chain.LastHash)
+
+		var txs []*Transaction
+		if test.spend {
+			txs = append(txs, send(t, chain, owner, oldMiner, 30))
+		}
+		oldTip := genesis
+		for i := 0; i < test.oldLen; i++ {
+			oldTip = mineOn(t, chain, oldTip, oldMiner, txs...)
+			txs = nil
+		}
+		newTip := genesis
+		for i := 0; i < test.newLen; i++ {
+			newTip = mineOn(t, chain, newTip, newMiner)
+		}
+
+		wantTip, wantOwner, wantOld, wantNew := oldTip, 100, test.oldLen*100, 0
+		if test.spend {
+			wantOwner, wantOld = 70, wantOld+30
+		}
+		if test.switched {
+			wantTip, wantOwner, wantOld, wantNew = newTip, 100, 0, test.newLen*100
+		}
+
+		if bytes.Compare(chain.LastHash, wantTip.Hash) != 0 {
+			t.Errorf("%s: tip is %x, want %x", test.name, chain.LastHash, wantTip.Hash)
+		}
+		for _, balances := range []struct {
+			name      string
+			got, want int
+		}{
+			{"owner", balance(t, chain, owner), wantOwner},
+			{"old miner", balance(t, chain, oldMiner), wantOld},
+			{"new miner", balance(t, chain, newMiner), wantNew},
+		} {
+			if balances.got != balances.want {
+				t.Errorf("%s: %s has %d, want %d", test.name, balances.name, balances.got, balances.want)
+			}
+		}
+		if hash, err := chain.GetBlockHash(wantTip.Height); err != nil || bytes.Compare(hash, wantTip.Hash) != 0 {
+			t.Errorf("%s: height %d is %x, %v, want %x", test.name, wantTip.Height, hash, err, wantTip.Hash)
+		}
+		checkUTXOSet(t, chain)
+	}
+}
+
+//A branch whose blocks can't be disconnected used to be switched to without checking the new one, now the old branch
+//is put back and stays the best chain
+func TestReorganizeKeepsTipWithoutUndo(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	first := mineOn(t, chain, genesis, owner, send(t, chain, owner, other, 30))
+	oldTip := mineOn(t, chain, first, owner)
+	if err := chain.Database.Delete(undoKey(first.Hash)); err != nil {
+		t.Fatal(err)
+	}
+
+	newTip := genesis
+	for i := 0; i < 2; i++ {
+		newTip = mineOn(t, chain, newTip, other)
+	}
+	if err := chain.AddBlock(newTestBlock(t, chain, newTip, other, nil)); err == nil {
+		t.Fatal("switched to the new branch without the old branch's undo data")
+	}
+
+	if bytes.Compare(chain.LastHash, oldTip.Hash) != 0 {
+		t.Errorf("tip is %x, want %x", chain.LastHash, oldTip.Hash)
+	}
+	if lastHash, err := chain.Database.Get(lastHashKey); err != nil || bytes.Compare(lastHash, oldTip.Hash) != 0 {
+		t.Errorf("stored tip is %x, %v, want %x", lastHash, err, oldTip.Hash)
+	}
+	if got := balance(t, chain, other); got != 30 {
+		t.Errorf("other has %d, want 30", got)
+	}
+	checkUTXOSet(t, chain)
+}
+
+//A branch with a block that fails against the UTXO set gets it marked invalid, and the old branch put back
+func TestReorganizeInvalidBranch(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+	oldTip := mineOn(t, chain, genesis, owner)
+
+	//Only checked against the UTXO set once its branch is connected
+	bad := newTestBlock(t, chain, genesis, other, func(b *Block) {
+		b.Transactions[0].Outputs[0].Value++
+		b.Transactions[0].SetID()
+		b.MerkleRoot = b.HashTransactions()
+	})
+	if err := chain.AddBlock(bad); err != nil {
+		t.Fatal(err)
+	}
+	err := chain.AddBlock(newTestBlock(t, chain, bad, other, nil))
+	if !errors.Is(err, ErrBadCoinbaseValue) {
+		t.Errorf("got %v, want %v", err, ErrBadCoinbaseValue)
+	}
+
+	if bytes.Compare(chain.LastHash, oldTip.Hash) != 0 {
+		t.Errorf("tip is %x, want %x", chain.LastHash, oldTip.Hash)
+	}
+	if invalid, err := chain.IsInvalid(bad.Hash); err != nil || !invalid {
+		t.Errorf("block %x is not marked invalid", bad.Hash)
+	}
+	checkUTXOSet(t, chain)
+}
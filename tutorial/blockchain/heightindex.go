@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"fmt"
+)
+
+var (
+	heightPrefix   = []byte("height-")
+	heightIndexKey = []byte("heightindex") //Set once the height index covers the whole best chain
+)
+
+//heightEntry is the key of the best chain's block at a height. Heights are big endian, so the keys sort by height
+func heightEntry(height int) []byte {
+	return append(append([]byte{}, heightPrefix...), ToHex(int64(height))...)
+}
+
+//indexHeight records the block as the best chain's block at its height, as it is connected
+func indexHeight(batch Batch, block *Block) error {
+	return batch.Put(heightEntry(block.Height), block.Hash)
+}
+
+//unindexHeight removes the block's height from the index, as it is disconnected
+func unindexHeight(batch Batch, block *Block) error {
+	return batch.Delete(heightEntry(block.Height))
+}
+
+//GetBlockHash returns the hash of the best chain's block at a height.
+//It returns an error wrapping ErrBlockNotFound if the best chain isn't that long
+func (chain *BlockChain) GetBlockHash(height int) ([]byte, error) {
+	hash, err := chain.Database.Get(heightEntry(height))
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+	}
+	return hash, err
+}
+
+//GetBlockByHeight returns the best chain's block at a height
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHash(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return chain.GetBlock(hash)
+}
+
+//BestHeight returns the height of the block at the tip of the chain
+func (chain *BlockChain) BestHeight() (int, error) {
+	lastHash, err := chain.Database.Get(lastHashKey)
+	if err != nil {
+		return 0, err
+	}
+	lastBlock, err := getBlock(chain.Database, lastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return lastBlock.Height, nil
+}
+
+//ReindexHeights rebuilds the height index from the blocks of the best chain
+func (chain *BlockChain) ReindexHeights() error {
+	db := chain.Database
+
+	if err := db.Delete(heightIndexKey); err != nil {
+		return err
+	}
+	if err := deleteByPrefix(db, heightPrefix); err != nil {
+		return err
+	}
+
+	iterator := chain.Iterator()
+	for {
+		block, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		if err := db.Put(heightEntry(block.Height), block.Hash); err != nil {
+			return err
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return db.Put(heightIndexKey, []byte{1})
+}
+
+//hasHeightIndex says whether the height index has been built, which it hasn't for chains from before there was one
+func hasHeightIndex(db Reader) (bool, error) {
+	_, err := db.Get(heightIndexKey)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+//Heights give the blocks of the best chain only, following it through a reorganization and a reindex
+func TestHeightIndex(t *testing.T) {
+	owner, oldMiner, newMiner := newWallet(t), newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	oldBranch := []*Block{genesis}
+	for i := 0; i < 2; i++ {
+		oldBranch = append(oldBranch, mineOn(t, chain, oldBranch[len(oldBranch)-1], oldMiner))
+	}
+	newBranch := []*Block{genesis}
+	for i := 0; i < 2; i++ {
+		newBranch = append(newBranch, mineOn(t, chain, newBranch[len(newBranch)-1], newMiner))
+	}
+
+	check := func(when string, best []*Block) {
+		t.Helper()
+		for height, want := range best {
+			if hash, err := chain.GetBlockHash(height); err != nil || !bytes.Equal(hash, want.Hash) {
+				t.Errorf("%s: height %d is %x, %v, want %x", when, height, hash, err, want.Hash)
+			}
+			if block, err := chain.GetBlockByHeight(height); err != nil || block.Height != height {
+				t.Errorf("%s: block at height %d is at %d, %v", when, height, block.Height, err)
+			}
+		}
+		if _, err := chain.GetBlockHash(len(best)); !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("%s: height %d: got %v, want %v", when, len(best), err, ErrBlockNotFound)
+		}
+		if height, err := chain.BestHeight(); err != nil || height != len(best)-1 {
+			t.Errorf("%s: best height is %d, %v, want %d", when, height, err, len(best)-1)
+		}
+	}
+
+	check("before the reorganization", oldBranch)
+
+	newBranch = append(newBranch, mineOn(t, chain, newBranch[len(newBranch)-1], newMiner))
+	check("after the reorganization", newBranch)
+
+	if err := chain.ReindexHeights(); err != nil {
+		t.Fatal(err)
+	}
+	check("after reindexing", newBranch)
+}
@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"encoding/hex"
+	"encoding/json"
+)
+
+//hexBytes is a byte slice written to JSON as a hex string
+type hexBytes []byte
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+//UnmarshalText reads a hex string. An empty one comes back as nil, the same as from the binary encoding
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	if len(decoded) == 0 {
+		decoded = nil
+	}
+	*b = decoded
+	return nil
+}
+
+type txInputJSON struct {
+	TxID      hexBytes `json:"txid"`
+	Out       int      `json:"out"`
+	Signature hexBytes `json:"signature"`
+	PubKey    hexBytes `json:"pubKey"`
+	Address   string   `json:"address,omitempty"` //Of PubKey, left out for a coinbase. Ignored when decoding
+}
+
+type txOutputJSON struct {
+	Value      int      `json:"value"`
+	PubKeyHash hexBytes `json:"pubKeyHash,omitempty"`
+	Address    string   `json:"address,omitempty"` //Of PubKeyHash. Only used when decoding if there is no PubKeyHash
+}
+
+type transactionJSON struct {
+	ID       hexBytes   `json:"id"`
+	Coinbase bool       `json:"coinbase"` //Ignored when decoding
+	Inputs   []TxInput  `json:"inputs"`
+	Outputs  []TxOutput `json:"outputs"`
+}
+
+type blockJSON struct {
+	Hash         hexBytes       `json:"hash"`
+	Version      int            `json:"version"`
+	Height       int            `json:"height"`
+	Timestamp    int64          `json:"timestamp"` //Unix seconds
+	PrevHash     hexBytes       `json:"prevHash"`
+	MerkleRoot   hexBytes       `json:"merkleRoot"`
+	Bits         int            `json:"bits"`
+	Nonce        uint32         `json:"nonce"`
+	Signer       hexBytes       `json:"signer,omitempty"`
+	Vote         hexBytes       `json:"vote,omitempty"`
+	VoteAdd      bool           `json:"voteAdd,omitempty"`
+	Signature    hexBytes       `json:"signature,omitempty"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+func (in TxInput) MarshalJSON() ([]byte, error) {
+	data := txInputJSON{TxID: in.ID, Out: in.Out, Signature: in.Signature, PubKey: in.PubKey}
+	if len(in.ID) != 0 {
+		data.Address = wallet.PubKeyHashToAddress(wallet.PublicKeyHash(in.PubKey))
+	}
+	return json.Marshal(data)
+}
+
+func (in *TxInput) UnmarshalJSON(text []byte) error {
+	var data txInputJSON
+	if err := json.Unmarshal(text, &data); err != nil {
+		return err
+	}
+
+	*in = TxInput{ID: data.TxID, Out: data.Out, Signature: data.Signature, PubKey: data.PubKey}
+	return nil
+}
+
+//MarshalJSON writes the output with the address of the active network its PubKeyHash belongs to
+func (out TxOutput) MarshalJSON() ([]byte, error) {
+	return json.Marshal(txOutputJSON{out.Value, out.PubKeyHash, wallet.PubKeyHashToAddress(out.PubKeyHash)})
+}
+
+//UnmarshalJSON reads an output locked to pubKeyHash, or to address if there is no pubKeyHash.
+//It returns wallet.ErrInvalidAddress for an address that isn't valid on the active network
+func (out *TxOutput) UnmarshalJSON(text []byte) error {
+	var data txOutputJSON
+	if err := json.Unmarshal(text, &data); err != nil {
+		return err
+	}
+
+	*out = TxOutput{Value: data.Value, PubKeyHash: data.PubKeyHash}
+	if len(out.PubKeyHash) == 0 && data.Address != "" {
+		return out.Lock([]byte(data.Address))
+	}
+	return nil
+}
+
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(transactionJSON{tx.ID, tx.IsCoinbase(), tx.Inputs, tx.Outputs})
+}
+
+func (tx *Transaction) UnmarshalJSON(text []byte) error {
+	var data transactionJSON
+	if err := json.Unmarshal(text, &data); err != nil {
+		return err
+	}
+
+	*tx = Transaction{ID: data.ID, Inputs: data.Inputs, Outputs: data.Outputs}
+	return nil
+}
+
+func (b Block) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blockJSON{
+		Hash:         b.Hash,
+		Version:      b.Version,
+		Height:       b.Height,
+		Timestamp:    b.Timestamp,
+		PrevHash:     b.PrevHash,
+		MerkleRoot:   b.MerkleRoot,
+		Bits:         b.Bits,
+		Nonce:        b.Nonce,
+		Signer:       b.Signer,
+		Vote:         b.Vote,
+		VoteAdd:      b.VoteAdd,
+		Signature:    b.Signature,
+		Transactions: b.Transactions,
+	})
+}
+
+func (b *Block) UnmarshalJSON(text []byte) error {
+	var data blockJSON
+	if err := json.Unmarshal(text, &data); err != nil {
+		return err
+	}
+
+	*b = Block{
+		BlockHeader: BlockHeader{
+			Version:    data.Version,
+			Height:     data.Height,
+			Timestamp:  data.Timestamp,
+			PrevHash:   data.PrevHash,
+			MerkleRoot: data.MerkleRoot,
+			Bits:       data.Bits,
+			Signer:     data.Signer,
+			Vote:       data.Vote,
+			VoteAdd:    data.VoteAdd,
+			Nonce:      data.Nonce,
+		},
+		Hash:         data.Hash,
+		Signature:    data.Signature,
+		Transactions: data.Transactions,
+	}
+	return nil
+}
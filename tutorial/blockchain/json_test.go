@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//goldenTx as written out on regtest. The addresses are those of the input's PubKey and the output's PubKeyHash
+const goldenTxJSON = `{"id":"aabb","coinbase":false,` +
+	`"inputs":[{"txid":"01","out":-1,"signature":"0203","pubKey":"04","address":"mqUs3RtLYZX1pRHYSFtgx6hrp4wP66r5Vs"}],` +
+	`"outputs":[{"value":100,"pubKeyHash":"0506","address":"5D1qki9jv8"}]}`
+
+func TestJSONGolden(t *testing.T) {
+	block := &Block{
+		BlockHeader:  BlockHeader{Version: 2, Height: 1, Timestamp: 1, PrevHash: []byte{0x0a}, MerkleRoot: []byte{0x0b}, Nonce: 5},
+		Hash:         []byte{0x0c},
+		Transactions: []*Transaction{&goldenTx},
+	}
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    string
+		decoded interface{}
+	}{
+		{"transaction", goldenTx, goldenTxJSON, &Transaction{}},
+		{"block", block, `{"hash":"0c","version":2,"height":1,"timestamp":1,"prevHash":"0a","merkleRoot":"0b","bits":0,` +
+			`"nonce":5,"transactions":[` + goldenTxJSON + `]}`, &Block{}},
+	}
+
+	for _, test := range tests {
+		got, err := json.Marshal(test.value)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("%s is written as\n%s\nwant\n%s", test.name, got, test.want)
+		}
+
+		if err := json.Unmarshal([]byte(test.want), test.decoded); err != nil {
+			t.Errorf("reading %s: %s", test.name, err)
+			continue
+		}
+		want := test.value
+		if tx, ok := want.(Transaction); ok {
+			want = &tx
+		}
+		if !reflect.DeepEqual(test.decoded, want) {
+			t.Errorf("%s is read as %+v, want %+v", test.name, test.decoded, want)
+		}
+	}
+}
+
+//Blocks of a real chain, and one with every signing field set, read back as they were and still validate
+func TestJSONRoundTrip(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+	block := newTestBlock(t, chain, genesis, other, nil, send(t, chain, owner, other, 30))
+
+	signed := *block
+	signed.Signer, signed.Vote, signed.VoteAdd, signed.Signature = []byte{0x01}, []byte{0x02}, true, []byte{0x03}
+
+	for _, original := range []*Block{genesis, block, &signed} {
+		data, err := json.Marshal(original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Block
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("reading %s: %s", data, err)
+		}
+		//Empty fields come back nil from either encoding
+		want, err := Deserialize(original.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&decoded, want) {
+			t.Errorf("block %d is read as %+v, want %+v", original.Height, decoded, *want)
+		}
+	}
+
+	var decoded Block
+	data, _ := json.Marshal(block)
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ValidateBlock(&decoded); err != nil {
+		t.Errorf("block read from JSON: %s", err)
+	}
+}
+
+//An output can be given by address alone, which has to be valid on the active network
+func TestOutputFromAddress(t *testing.T) {
+	w := newWallet(t)
+
+	var out TxOutput
+	if err := json.Unmarshal([]byte(`{"value":5,"address":"`+address(w)+`"}`), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Value != 5 || !bytes.Equal(out.PubKeyHash, wallet.PublicKeyHash(w.PublicKey)) {
+		t.Errorf("got %d locked to %x, want 5 locked to %x", out.Value, out.PubKeyHash, wallet.PublicKeyHash(w.PublicKey))
+	}
+
+	if err := json.Unmarshal([]byte(`{"value":5,"address":"5D1qki9jv9"}`), &out); !errors.Is(err, wallet.ErrInvalidAddress) {
+		t.Errorf("bad checksum: got %v, want %v", err, wallet.ErrInvalidAddress)
+	}
+}
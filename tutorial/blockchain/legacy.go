@@ -0,0 +1,371 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+)
+
+//Before the binary encoding, records were written with encoding/gob, and transaction IDs and signatures were computed
+//over its output. Blocks from then are version 1. Their transactions keep the IDs they were given, and their
+//signatures are checked over gob as they were made
+
+const (
+	binaryBlockVersion = 2  //First block version whose transactions are hashed over the binary encoding
+	legacyBits         = 12 //Difficulty every block was mined at before blocks kept theirs
+)
+
+var (
+	encodingKey    = []byte("encoding")    //Set once every record is in the binary encoding
+	blockPrefixKey = []byte("blockprefix") //Set once every block is kept under blockPrefix
+)
+
+//gob hands out type ids in the order types are first seen by the process, and those ids end up in the encoded bytes.
+//Encoding a block up front pins the ids for every type that legacy transaction hashes are computed over, so that every
+//process (CLI or node) derives the same hashes no matter what else it has encoded before.
+func init() {
+	if err := gob.NewEncoder(ioutil.Discard).Encode(Block{}); err != nil {
+		log.Panic(err)
+	}
+}
+
+//isLegacyBlock says whether the block's transactions were hashed and signed over gob
+func isLegacyBlock(block *Block) bool {
+	return block.Version < binaryBlockVersion
+}
+
+//legacyHash is Hash as it was computed over gob
+func (tx *Transaction) legacyHash() []byte {
+	var encoded bytes.Buffer
+
+	txCopy := *tx
+	txCopy.ID = []byte{}
+
+	if err := gob.NewEncoder(&encoded).Encode(txCopy); err != nil {
+		log.Panic(err)
+	}
+
+	hash := sha256.Sum256(encoded.Bytes())
+	return hash[:]
+}
+
+//verifyLegacySignature is verifySignature for signatures and public keys that weren't padded, which were split in half
+func verifyLegacySignature(in TxInput, hash []byte) bool {
+	r := big.Int{}
+	s := big.Int{}
+	signatureLength := len(in.Signature)
+	r.SetBytes(in.Signature[:(signatureLength / 2)])
+	s.SetBytes(in.Signature[(signatureLength / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLength := len(in.PubKey)
+	x.SetBytes(in.PubKey[:(keyLength / 2)])
+	y.SetBytes(in.PubKey[(keyLength / 2):])
+
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
+}
+
+//legacyBlock is a block as gob wrote it, with the nonce an int as it was then. Blocks from before the header kept
+//PrevHash and Nonce at the top, later ones in their BlockHeader
+type legacyBlock struct {
+	BlockHeader  legacyHeader
+	Hash         []byte
+	Signature    []byte
+	Transactions []*Transaction
+	PrevHash     []byte
+	Nonce        int
+}
+
+type legacyHeader struct {
+	Version    int
+	Height     int
+	Timestamp  int64
+	PrevHash   []byte
+	MerkleRoot []byte
+	Bits       int
+	Signer     []byte
+	Vote       []byte
+	VoteAdd    bool
+	Nonce      int
+}
+
+func (old *legacyBlock) block() *Block {
+	header := old.BlockHeader
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:    header.Version,
+			Height:     header.Height,
+			Timestamp:  header.Timestamp,
+			PrevHash:   header.PrevHash,
+			MerkleRoot: header.MerkleRoot,
+			Bits:       header.Bits,
+			Signer:     header.Signer,
+			Vote:       header.Vote,
+			VoteAdd:    header.VoteAdd,
+			Nonce:      uint32(header.Nonce),
+		},
+		Hash:         old.Hash,
+		Signature:    old.Signature,
+		Transactions: old.Transactions,
+	}
+	if header.Version == 0 {
+		block.PrevHash = old.PrevHash
+		block.Nonce = uint32(old.Nonce)
+	}
+
+	return block
+}
+
+//legacyRecord is a kind of record that used to be written with gob
+type legacyRecord struct {
+	name    string
+	isKey   func(key []byte) bool
+	current func(data []byte) error           //Decodes a record already in the binary encoding
+	convert func(data []byte) ([]byte, error) //Decodes a gob record and encodes it again
+}
+
+//migrateEncoding rewrites every record gob wrote in the binary encoding, keeping every hash and ID as it was.
+//Records already in the binary encoding are left alone, so a migration that stopped part of the way through
+//picks up where it left off. UTXO entries and undo records from before the UTXO set was kept per output are left
+//for the migration of the UTXO set, which throws them away
+func (chain *BlockChain) migrateEncoding() error {
+	db := chain.Database
+
+	records := []legacyRecord{
+		{
+			"block",
+			func(key []byte) bool { return bytes.HasPrefix(key, blockPrefix) },
+			func(data []byte) error { _, err := Deserialize(data); return err },
+			func(data []byte) ([]byte, error) {
+				var block legacyBlock
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block)
+				return block.block().Serialize(), err
+			},
+		},
+		{
+			"tx location",
+			func(key []byte) bool { return bytes.HasPrefix(key, txIndexPrefix) },
+			func(data []byte) error { _, err := DeserializeTxLocation(data); return err },
+			func(data []byte) ([]byte, error) {
+				var location TxLocation
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&location)
+				return location.Serialize(), err
+			},
+		},
+		{
+			"proposals",
+			func(key []byte) bool { return bytes.Equal(key, proposalsKey) },
+			func(data []byte) error { _, err := deserializeProposals(data); return err },
+			func(data []byte) ([]byte, error) {
+				var proposals map[string]bool
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&proposals)
+				return serializeProposals(proposals), err
+			},
+		},
+	}
+
+	perOutput, err := hasUTXOVersion(db)
+	if err != nil {
+		return err
+	}
+	if perOutput {
+		records = append(records, legacyRecord{
+			"utxo",
+			func(key []byte) bool { return bytes.HasPrefix(key, utxoPrefix) },
+			func(data []byte) error { _, err := DeserializeUTXO(data); return err },
+			func(data []byte) ([]byte, error) {
+				var utxo UTXO
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&utxo)
+				return utxo.Serialize(), err
+			},
+		}, legacyRecord{
+			"undo",
+			func(key []byte) bool { return bytes.HasPrefix(key, undoPrefix) },
+			func(data []byte) error { _, err := DeserializeUndo(data); return err },
+			func(data []byte) ([]byte, error) {
+				var undo BlockUndo
+				err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+				return undo.Serialize(), err
+			},
+		})
+	}
+
+	//Keys are collected first, so none are rewritten under the iteration
+	keys := make([][][]byte, len(records))
+	err = db.Iterate(nil, func(key, value []byte) error {
+		for i, record := range records {
+			if record.isKey(key) {
+				keys[i] = append(keys[i], append([]byte{}, key...))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, record := range records {
+		converted := 0
+		for _, key := range keys[i] {
+			data, err := db.Get(key)
+			if err != nil {
+				return err
+			}
+			if record.current(data) == nil {
+				continue
+			}
+
+			encoded, err := record.convert(data)
+			if err != nil {
+				return fmt.Errorf("%w: %s %x: %s", ErrCorrupt, record.name, key, err)
+			}
+			if err := db.Put(key, encoded); err != nil {
+				return err
+			}
+			converted++
+		}
+		fmt.Printf("Converted %d %s records\n", converted, record.name)
+	}
+
+	if err := chain.fillLegacyHeaders(); err != nil {
+		return err
+	}
+
+	return db.Put(encodingKey, []byte{EncodingVersion})
+}
+
+//fillLegacyHeaders fills in the headers of blocks from before blocks had one, which come out of gob as version 0
+//with nothing but their PrevHash and Nonce. They become version 1 blocks with the difficulty they were mined at, the
+//merkle root of their transactions, and their height counted from the genesis block. When they were mined wasn't
+//kept, so their timestamp stays 0. A block is only rewritten once its header is filled in, so a migration that
+//stopped part of the way through picks up where it left off
+func (chain *BlockChain) fillLegacyHeaders() error {
+	db := chain.Database
+
+	blocks := make(map[string]*Block)
+	err := db.Iterate(blockPrefix, func(key, value []byte) error {
+		block, err := Deserialize(value)
+		if err != nil {
+			return fmt.Errorf("%w: block %x: %s", ErrCorrupt, key, err)
+		}
+		if block.Version == 0 {
+			blocks[string(block.Hash)] = block
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//Each block's height is counted up from the closest block before it whose height is known
+	heights := make(map[string]int)
+	for _, block := range blocks {
+		var branch []*Block
+		height := -1
+		for current := block; ; {
+			if known, ok := heights[string(current.Hash)]; ok {
+				height = known
+				break
+			}
+			if current.Version != 0 {
+				height = current.Height
+				break
+			}
+			branch = append(branch, current)
+			if len(current.PrevHash) == 0 {
+				break
+			}
+
+			parent, ok := blocks[string(current.PrevHash)]
+			if !ok {
+				if parent, err = getBlock(db, current.PrevHash); err != nil {
+					return fmt.Errorf("%w: parent %x of block %x: %s", ErrCorrupt, current.PrevHash, current.Hash, err)
+				}
+			}
+			current = parent
+		}
+
+		for i := len(branch) - 1; i >= 0; i-- {
+			height++
+			heights[string(branch[i].Hash)] = height
+		}
+	}
+
+	for hash, block := range blocks {
+		block.Version = 1
+		block.Height = heights[hash]
+		block.Bits = legacyBits
+		block.MerkleRoot = block.HashTransactions()
+		if err := db.Put(blockKey(block.Hash), block.Serialize()); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Filled in the headers of %d blocks\n", len(blocks))
+
+	return nil
+}
+
+//hasBinaryEncoding says whether every record is in the binary encoding, which they aren't for chains from before it
+func hasBinaryEncoding(db Reader) (bool, error) {
+	_, err := db.Get(encodingKey)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//migrateBlockKeys moves every block from under its bare hash, which could start with the prefix of another kind of
+//record, to under blockPrefix. Each block is moved in an update of its own, so a migration that stopped part of the
+//way through picks up where it left off
+func (chain *BlockChain) migrateBlockKeys() error {
+	db := chain.Database
+
+	//Blocks are the only records that were kept under a key of the length of a hash
+	var hashes [][]byte
+	err := db.Iterate(nil, func(key, value []byte) error {
+		if len(key) == sha256.Size {
+			hashes = append(hashes, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		err := db.Update(func(batch Batch) error {
+			data, err := batch.Get(hash)
+			if err != nil {
+				return err
+			}
+			if err := batch.Put(blockKey(hash), data); err != nil {
+				return err
+			}
+			return batch.Delete(hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Moved %d blocks\n", len(hashes))
+
+	return db.Put(blockPrefixKey, []byte{1})
+}
+
+//hasBlockPrefix says whether blocks are kept under blockPrefix, which they aren't for chains from before it
+func hasBlockPrefix(db Reader) (bool, error) {
+	_, err := db.Get(blockPrefixKey)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"math/big"
+	"testing"
+)
+
+//baselineBlock is a block as the first version of the chain had it, without a header
+type baselineBlock struct {
+	Hash         []byte
+	Transactions []*Transaction
+	PrevHash     []byte
+	Nonce        int
+}
+
+//A chain from the first version has its blocks, gob encoded under their bare hash, moved over with their headers
+//filled in: the height counted from the genesis block, the difficulty every block was mined at then, and the merkle
+//root of their transactions
+func TestMigrateBaselineChain(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	store := NewMemoryStore()
+
+	var hashes [][]byte
+	prevHash := []byte{}
+	for i, miner := range []string{address(owner), address(other), address(other)} {
+		coinbase, err := CoinbaseTx(miner, "", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coinbase.ID = coinbase.legacyHash()
+
+		//The hashes aren't checked again, so any will do
+		hash := sha256.Sum256([]byte{byte(i)})
+		var encoded bytes.Buffer
+		block := baselineBlock{hash[:], []*Transaction{coinbase}, prevHash, 1000 + i}
+		if err := gob.NewEncoder(&encoded).Encode(block); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(hash[:], encoded.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, hash[:])
+		prevHash = hash[:]
+	}
+	if err := store.Put(lastHashKey, prevHash); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := LoadBlockChain(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for height, hash := range hashes {
+		block := getBlockT(t, chain, hash)
+		if block.Version != 1 || block.Height != height || block.Bits != legacyBits || block.Nonce != uint32(1000+height) {
+			t.Errorf("block %x has version %d, height %d, bits %d and nonce %d, want 1, %d, %d and %d", hash,
+				block.Version, block.Height, block.Bits, block.Nonce, height, legacyBits, 1000+height)
+		}
+		if bytes.Compare(block.MerkleRoot, block.HashTransactions()) != 0 {
+			t.Errorf("block %x has merkle root %x, want %x", hash, block.MerkleRoot, block.HashTransactions())
+		}
+		if byHeight, err := chain.GetBlockHash(height); err != nil || bytes.Compare(byHeight, hash) != 0 {
+			t.Errorf("height %d is %x, %v, want %x", height, byHeight, err, hash)
+		}
+	}
+
+	work, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := BlockWork(legacyBits); work.Cmp(want.Mul(want, big.NewInt(3))) != 0 {
+		t.Errorf("chain work is %d, want 3 blocks at %d bits", work, legacyBits)
+	}
+	if got := balance(t, chain, owner); got != 100 {
+		t.Errorf("owner has %d, want 100", got)
+	}
+	if got := balance(t, chain, other); got != 200 {
+		t.Errorf("other has %d, want 200", got)
+	}
+
+	//Blocks on top of a migrated chain are checked as usual
+	mineOn(t, chain, getBlockT(t, chain, chain.LastHash), owner)
+	checkUTXOSet(t, chain)
+}
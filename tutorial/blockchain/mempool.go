@@ -0,0 +1,365 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	blockReserve = 1000 //Room a miner leaves in a block for the header and the coinbase
+)
+
+var (
+	ErrAlreadyInMempool  = errors.New("transaction is already in the mempool")
+	ErrMempoolConflict   = errors.New("output is already spent by a pending transaction")
+	ErrCoinbaseInMempool = errors.New("coinbase transactions can only be mined, not sent")
+)
+
+//MempoolEntry is a pending transaction along with what it pays to be mined
+type MempoolEntry struct {
+	Tx    *Transaction
+	Fee   int
+	Size  int
+	Added time.Time
+}
+
+//Mempool holds the transactions that have been validated but not mined yet.
+//Every transaction in it spends outputs that are either in the UTXO set or created by another pending transaction,
+//and no two of them spend the same output
+type Mempool struct {
+	chain   *BlockChain
+	mutex   sync.Mutex
+	entries map[string]*MempoolEntry
+	spends  map[string]string //Outpoint to the ID of the pending transaction spending it
+}
+
+func NewMempool(chain *BlockChain) *Mempool {
+	return &Mempool{
+		chain:   chain,
+		entries: make(map[string]*MempoolEntry),
+		spends:  make(map[string]string),
+	}
+}
+
+func outpoint(in TxInput) string {
+	return fmt.Sprintf("%x:%d", in.ID, in.Out)
+}
+
+//Add validates a transaction against the UTXO set and the other pending transactions, and keeps it if it passes
+func (pool *Mempool) Add(tx *Transaction) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return pool.add(tx, time.Now())
+}
+
+func (pool *Mempool) add(tx *Transaction, added time.Time) error {
+	txID := hex.EncodeToString(tx.ID)
+
+	if err := checkTransaction(tx); err != nil {
+		return err
+	}
+	//Entries are kept by ID, a transaction under someone else's ID could take its place
+	if err := checkTransactionID(tx, false); err != nil {
+		return err
+	}
+	if tx.IsCoinbase() {
+		return txError(tx, ErrCoinbaseInMempool, "")
+	}
+	if _, ok := pool.entries[txID]; ok {
+		return txError(tx, ErrAlreadyInMempool, "")
+	}
+
+	pending := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		if other, ok := pool.spends[outpoint(in)]; ok {
+			return txError(tx, ErrMempoolConflict, "%s is spent by %s", outpoint(in), other)
+		}
+		if parent, ok := pool.entries[hex.EncodeToString(in.ID)]; ok {
+			pending[hex.EncodeToString(in.ID)] = *parent.Tx
+		}
+	}
+
+	fee, err := pool.chain.checkTransactionInputs(tx, pending, false)
+	if err != nil {
+		return err
+	}
+
+	pool.entries[txID] = &MempoolEntry{tx, fee, len(tx.Serialize()), added}
+	for _, in := range tx.Inputs {
+		pool.spends[outpoint(in)] = txID
+	}
+
+	return nil
+}
+
+func (pool *Mempool) Get(txID []byte) (*Transaction, bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	entry, ok := pool.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return nil, false
+	}
+	return entry.Tx, true
+}
+
+func (pool *Mempool) Has(txID []byte) bool {
+	_, ok := pool.Get(txID)
+	return ok
+}
+
+func (pool *Mempool) Count() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return len(pool.entries)
+}
+
+//Remove drops a transaction from the pool, along with every pending transaction that spends its outputs
+func (pool *Mempool) Remove(txID []byte) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.remove(hex.EncodeToString(txID))
+}
+
+func (pool *Mempool) remove(txID string) {
+	entry, ok := pool.entries[txID]
+	if !ok {
+		return
+	}
+
+	delete(pool.entries, txID)
+	for _, in := range entry.Tx.Inputs {
+		delete(pool.spends, outpoint(in))
+	}
+
+	for out := range entry.Tx.Outputs {
+		if child, ok := pool.spends[fmt.Sprintf("%s:%d", txID, out)]; ok {
+			pool.remove(child)
+		}
+	}
+}
+
+//RemoveBlock is called once a block extending the tip is connected. Its transactions leave the pool, and so does
+//any pending transaction that spends the same outputs they did
+func (pool *Mempool) RemoveBlock(block *Block) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		if entry, ok := pool.entries[txID]; ok {
+			//Children stay, the outputs they spend are in the UTXO set now
+			delete(pool.entries, txID)
+			for _, in := range entry.Tx.Inputs {
+				delete(pool.spends, outpoint(in))
+			}
+			continue
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if other, ok := pool.spends[outpoint(in)]; ok {
+				pool.remove(other)
+			}
+		}
+	}
+}
+
+//Revalidate checks every pending transaction again from scratch, for when the tip has moved in a way RemoveBlock
+//can't follow
+func (pool *Mempool) Revalidate() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.revalidate(nil)
+}
+
+//Reorganize is called once the best chain has switched from the branch ending at oldTip to another one.
+//The transactions of the blocks that left the best chain go back into the pool, then every pending transaction is
+//checked again, so those the new branch already mined or made invalid are dropped
+func (pool *Mempool) Reorganize(oldTip []byte) error {
+	old, err := pool.chain.GetBlock(oldTip)
+	if err != nil {
+		return err
+	}
+	newTip, err := pool.chain.GetBlock(pool.chain.LastHash)
+	if err != nil {
+		return err
+	}
+	detach, _, err := pool.chain.forkBranches(&old, &newTip)
+	if err != nil {
+		return err
+	}
+
+	var detached []*Transaction
+	for i := len(detach) - 1; i >= 0; i-- {
+		for _, tx := range detach[i].Transactions {
+			if !tx.IsCoinbase() {
+				detached = append(detached, tx)
+			}
+		}
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.revalidate(detached)
+	return nil
+}
+
+//revalidate empties the pool and adds first the given transactions, in order, then the pending ones in arrival order
+func (pool *Mempool) revalidate(first []*Transaction) {
+	entries := make([]*MempoolEntry, 0, len(pool.entries))
+	for _, entry := range pool.entries {
+		entries = append(entries, entry)
+	}
+	//Parents always arrive before their children, so re-adding in arrival order keeps every child's parent in place
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Added.Before(entries[j].Added)
+	})
+
+	//The first transactions count as arriving before every pending one, which may spend their outputs
+	added := time.Now()
+	if len(entries) > 0 {
+		added = entries[0].Added
+	}
+	added = added.Add(-time.Duration(len(first)))
+	readd := make([]*MempoolEntry, 0, len(first)+len(entries))
+	for i, tx := range first {
+		readd = append(readd, &MempoolEntry{Tx: tx, Added: added.Add(time.Duration(i))})
+	}
+	readd = append(readd, entries...)
+
+	pool.entries = make(map[string]*MempoolEntry)
+	pool.spends = make(map[string]string)
+	for _, entry := range readd {
+		if err := pool.add(entry.Tx, entry.Added); err != nil {
+			fmt.Printf("Dropped from the mempool: %s\n", err)
+		}
+	}
+}
+
+//SelectTransactions picks pending transactions for a block, highest fee rate first, up to maxSize bytes.
+//A transaction is only picked once every pending transaction it spends from has been picked before it
+func (pool *Mempool) SelectTransactions(maxSize int) []*Transaction {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	entries := make([]*MempoolEntry, 0, len(pool.entries))
+	for _, entry := range pool.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		//Compares Fee/Size without dividing
+		a, b := entries[i].Fee*entries[j].Size, entries[j].Fee*entries[i].Size
+		if a != b {
+			return a > b
+		}
+		return entries[i].Added.Before(entries[j].Added)
+	})
+
+	var txs []*Transaction
+	picked := make(map[string]bool)
+	size := 0
+
+	for progress := true; progress; {
+		progress = false
+
+		for _, entry := range entries {
+			txID := hex.EncodeToString(entry.Tx.ID)
+			if picked[txID] || size+entry.Size > maxSize {
+				continue
+			}
+
+			ready := true
+			for _, in := range entry.Tx.Inputs {
+				parentID := hex.EncodeToString(in.ID)
+				if _, pending := pool.entries[parentID]; pending && !picked[parentID] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			txs = append(txs, entry.Tx)
+			picked[txID] = true
+			size += entry.Size
+			progress = true
+		}
+	}
+
+	return txs
+}
+
+//Fees adds up the fees the given pending transactions pay
+func (pool *Mempool) Fees(txs []*Transaction) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	fees := 0
+	for _, tx := range txs {
+		if entry, ok := pool.entries[hex.EncodeToString(tx.ID)]; ok {
+			fees += entry.Fee
+		}
+	}
+
+	return fees
+}
+
+//BlockTemplate builds an unsealed block on top of the tip out of the best transactions in the pool, with a coinbase
+//paying the block subsidy and their fees to the given address. It returns nil when there is nothing to mine
+func (pool *Mempool) BlockTemplate(address string) (*Block, error) {
+	txs := pool.SelectTransactions(MaxBlockSize - blockReserve)
+	if len(txs) == 0 {
+		return nil, nil
+	}
+
+	lastBlock, err := pool.chain.GetBlock(pool.chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	height := lastBlock.Height + 1
+	cbTx, err := CoinbaseTx(address, "", BlockSubsidy(height)+pool.Fees(txs))
+	if err != nil {
+		return nil, err
+	}
+
+	block := NewBlock(append([]*Transaction{cbTx}, txs...), lastBlock.Hash, height, 0)
+	if err := pool.chain.Engine.Prepare(pool.chain, block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+//MineBlock seals a block from BlockTemplate, connects it and drops its transactions from the pool.
+//It returns nil when there is nothing to mine
+func (pool *Mempool) MineBlock(address string) (*Block, error) {
+	block, err := pool.BlockTemplate(address)
+	if err != nil || block == nil {
+		return nil, err
+	}
+
+	if err := pool.chain.Engine.Seal(context.Background(), pool.chain, block); err != nil {
+		return nil, err
+	}
+	if err := pool.chain.AddBlock(block); err != nil {
+		return nil, err
+	}
+	pool.RemoveBlock(block)
+
+	return block, nil
+}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMempoolAdd(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+	mineOn(t, chain, genesis, other)
+	pool := NewMempool(chain)
+
+	paid := send(t, chain, owner, other, 30)
+	fromOther := send(t, chain, other, owner, 50)
+	forged := send(t, chain, other, owner, 20)
+	forged.ID = paid.ID
+
+	//Steps run in order against the same pool
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want error
+	}{
+		{"valid", paid, nil},
+		{"duplicate", paid, ErrAlreadyInMempool},
+		{"spends a pending output", send(t, chain, owner, other, 40), ErrMempoolConflict},
+		{"forged ID of a pending transaction", forged, ErrBadTxID},
+		{"coinbase", genesis.Transactions[0], ErrCoinbaseInMempool},
+		{"no inputs", &Transaction{Outputs: paid.Outputs}, ErrEmptyTransaction},
+		{"valid from another wallet", fromOther, nil},
+	}
+
+	for _, test := range tests {
+		if err := pool.Add(test.tx); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	if pool.Count() != 2 || !pool.Has(paid.ID) || !pool.Has(fromOther.ID) {
+		t.Errorf("pool has %d transactions, want %x and %x", pool.Count(), paid.ID, fromOther.ID)
+	}
+	if got, _ := pool.Get(paid.ID); got != paid {
+		t.Errorf("%x was replaced", paid.ID)
+	}
+}
+
+//The transactions of blocks that leave the best chain go back into the pool, ahead of the pending ones spending them,
+//unless the new branch mined them too
+func TestMempoolReorganize(t *testing.T) {
+	for _, minedAgain := range []bool{false, true} {
+		owner, oldMiner, newMiner := newWallet(t), newWallet(t), newWallet(t)
+		chain := newTestChain(t, owner)
+		genesis := getBlockT(t, chain, chain.LastHash)
+		pool := NewMempool(chain)
+
+		paid := send(t, chain, owner, oldMiner, 30)
+		oldTip := mineOn(t, chain, genesis, oldMiner, paid)
+		child := send(t, chain, owner, oldMiner, 20) //Spends the change of paid
+		if err := pool.Add(child); err != nil {
+			t.Fatal(err)
+		}
+
+		var txs []*Transaction
+		if minedAgain {
+			txs = append(txs, paid)
+		}
+		newTip := mineOn(t, chain, genesis, newMiner, txs...)
+		mineOn(t, chain, newTip, newMiner)
+
+		if err := pool.Reorganize(oldTip.Hash); err != nil {
+			t.Fatal(err)
+		}
+		if pool.Has(paid.ID) == minedAgain || !pool.Has(child.ID) {
+			t.Errorf("mined again %t: pool has %x %t, %x %t", minedAgain, paid.ID, pool.Has(paid.ID), child.ID, pool.Has(child.ID))
+		}
+	}
+}
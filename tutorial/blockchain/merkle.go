@@ -0,0 +1,123 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+//MerkleTree commits to a list of transaction IDs with a single root hash.
+//The leaves are the IDs themselves, every other node is the SHA-256 of its two children joined together.
+//A level with an odd number of nodes pairs its last node with a copy of itself
+type MerkleTree struct {
+	RootNode *MerkleNode
+	Leaves   []*MerkleNode
+}
+
+type MerkleNode struct {
+	Left   *MerkleNode
+	Right  *MerkleNode
+	Parent *MerkleNode
+	Data   []byte
+}
+
+//MerkleProofStep is one sibling hash on the path from a leaf to the root
+type MerkleProofStep struct {
+	Hash []byte
+	Left bool //The sibling sits on the left, so it goes first when hashing the pair
+}
+
+//MerkleProof shows that TxID is part of the tree with the given MerkleRoot, without needing the other transactions
+type MerkleProof struct {
+	TxID       []byte
+	MerkleRoot []byte
+	Steps      []MerkleProofStep
+}
+
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	node := MerkleNode{}
+
+	if left == nil && right == nil {
+		node.Data = data
+	} else {
+		hash := sha256.Sum256(append(append([]byte{}, left.Data...), right.Data...))
+		node.Data = hash[:]
+		node.Left = left
+		node.Right = right
+		left.Parent = &node
+		right.Parent = &node
+	}
+
+	return &node
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		hash := sha256.Sum256([]byte{})
+		return &MerkleTree{RootNode: NewMerkleNode(nil, nil, hash[:])}
+	}
+
+	var leaves []*MerkleNode
+	for _, datum := range data {
+		leaves = append(leaves, NewMerkleNode(nil, nil, datum))
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		var nextLevel []*MerkleNode
+
+		for i := 0; i < len(level); i += 2 {
+			left := level[i]
+			var right *MerkleNode
+			if i+1 < len(level) {
+				right = level[i+1]
+			} else {
+				right = NewMerkleNode(nil, nil, left.Data) //Pairs the odd node out with a copy of itself
+			}
+			nextLevel = append(nextLevel, NewMerkleNode(left, right, nil))
+		}
+
+		level = nextLevel
+	}
+
+	return &MerkleTree{RootNode: level[0], Leaves: leaves}
+}
+
+//Proof collects the sibling hashes from the leaf holding data up to the root
+func (tree *MerkleTree) Proof(data []byte) (*MerkleProof, error) {
+	for _, leaf := range tree.Leaves {
+		if bytes.Compare(leaf.Data, data) != 0 {
+			continue
+		}
+
+		proof := MerkleProof{TxID: data, MerkleRoot: tree.RootNode.Data}
+		for node := leaf; node.Parent != nil; node = node.Parent {
+			if node.Parent.Left == node {
+				proof.Steps = append(proof.Steps, MerkleProofStep{node.Parent.Right.Data, false})
+			} else {
+				proof.Steps = append(proof.Steps, MerkleProofStep{node.Parent.Left.Data, true})
+			}
+		}
+
+		return &proof, nil
+	}
+
+	return nil, errors.New("transaction is not in the merkle tree")
+}
+
+//Verify rebuilds the root from the transaction ID and the proof steps, and checks it against MerkleRoot
+func (proof *MerkleProof) Verify() bool {
+	hash := proof.TxID
+
+	for _, step := range proof.Steps {
+		var sum [32]byte
+		if step.Left {
+			sum = sha256.Sum256(append(append([]byte{}, step.Hash...), hash...))
+		} else {
+			sum = sha256.Sum256(append(append([]byte{}, hash...), step.Hash...))
+		}
+		hash = sum[:]
+	}
+
+	return bytes.Compare(hash, proof.MerkleRoot) == 0
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func hashPair(left, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return sum[:]
+}
+
+func testLeaves(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		sum := sha256.Sum256([]byte{byte(i)})
+		leaves = append(leaves, sum[:])
+	}
+	return leaves
+}
+
+//Roots of small trees worked out by hand, the odd node out of a level paired with itself
+func TestMerkleRoot(t *testing.T) {
+	l := testLeaves(5)
+	empty := sha256.Sum256([]byte{})
+
+	tests := []struct {
+		name   string
+		leaves [][]byte
+		want   []byte
+	}{
+		{"no leaves", nil, empty[:]},
+		{"one leaf", l[:1], l[0]},
+		{"two leaves", l[:2], hashPair(l[0], l[1])},
+		{"three leaves", l[:3], hashPair(hashPair(l[0], l[1]), hashPair(l[2], l[2]))},
+		{"five leaves", l[:5], hashPair(
+			hashPair(hashPair(l[0], l[1]), hashPair(l[2], l[3])),
+			hashPair(hashPair(l[4], l[4]), hashPair(l[4], l[4])),
+		)},
+	}
+
+	for _, test := range tests {
+		if got := NewMerkleTree(test.leaves).RootNode.Data; !bytes.Equal(got, test.want) {
+			t.Errorf("%s: root is %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+//Every leaf of trees with odd and even numbers of leaves has a proof that verifies, and changing any part of it
+//makes it fail
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeaves(n)
+		other := testLeaves(n + 1)[n]
+		tree := NewMerkleTree(leaves)
+
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(leaf)
+			if err != nil {
+				t.Fatalf("%d leaves, leaf %d: %s", n, i, err)
+			}
+			if !bytes.Equal(proof.MerkleRoot, tree.RootNode.Data) || !proof.Verify() {
+				t.Errorf("%d leaves, leaf %d: proof doesn't verify", n, i)
+			}
+
+			tampered := map[string]func(p *MerkleProof){
+				"other transaction": func(p *MerkleProof) { p.TxID = other },
+				"other root":        func(p *MerkleProof) { p.MerkleRoot = other },
+			}
+			if len(proof.Steps) > 0 {
+				tampered["sibling changed"] = func(p *MerkleProof) { p.Steps[0].Hash = other }
+				tampered["side swapped"] = func(p *MerkleProof) { p.Steps[len(p.Steps)-1].Left = !p.Steps[len(p.Steps)-1].Left }
+				tampered["step dropped"] = func(p *MerkleProof) { p.Steps = p.Steps[1:] }
+				tampered["step added"] = func(p *MerkleProof) { p.Steps = append(p.Steps, p.Steps[0]) }
+			}
+			for name, tamper := range tampered {
+				copied := *proof
+				copied.Steps = append([]MerkleProofStep{}, proof.Steps...)
+				tamper(&copied)
+				if copied.Verify() {
+					t.Errorf("%d leaves, leaf %d: proof with %s verifies", n, i, name)
+				}
+			}
+		}
+
+		if _, err := tree.Proof(other); err == nil {
+			t.Errorf("%d leaves: got a proof for a leaf that isn't there", n)
+		}
+	}
+}
@@ -2,12 +2,19 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //Take the data from the block
@@ -20,42 +27,78 @@ import (
 // Repeat this until meets requirements
 
 const (
-	Difficulty = 12
+	MaxNonce      = math.MaxUint32 //Largest nonce a single search tries, before the header has to change
+	checkInterval = 1 << 14        //Hashes a mining worker tries between checks for cancellation
+)
+
+var (
+	MiningWorkers  = runtime.NumCPU() //Number of goroutines a proof of work search is split across
+	MiningProgress io.Writer          //When set, mining writes its hash rate here every second
+
+	ErrNonceSpaceExhausted = errors.New("no nonce meets the target")
 )
 
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int //references the requirement of difficulty
+
+	Hashes  uint64 //Hashes tried by the last Run
+	Elapsed time.Duration
 }
 
 func NewProof(b *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-b.Bits))
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{Block: b, Target: target}
 
 	return pow
 }
 
-func (pow *ProofOfWork) InitializeData(nonce int) []byte {
+//InitializeData serializes the block header with the given nonce
+func (pow *ProofOfWork) InitializeData(nonce uint32) []byte {
+	header := pow.Block.BlockHeader
+
+	var vote []byte
+	if len(header.Vote) > 0 {
+		vote = append(append(vote, header.Vote...), 0)
+		if header.VoteAdd {
+			vote[len(vote)-1] = 1
+		}
+	}
+
 	data := bytes.Join(
 		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
+			ToHex(int64(header.Version)),
+			ToHex(int64(header.Height)),
+			ToHex(header.Timestamp),
+			header.PrevHash,
+			header.MerkleRoot,
+			ToHex(int64(header.Bits)),
+			header.Signer,
+			vote,
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
 		},
 		[]byte{},
 	)
 	return data
 }
 
-func (pow *ProofOfWork) Validate() bool {
+//Validate checks that the block was mined at the expected difficulty for its height, that its hash is the hash of its
+//header, and that the hash meets the target
+func (pow *ProofOfWork) Validate(expectedBits int) bool {
 	var intHash big.Int
 
+	if pow.Block.Bits != expectedBits {
+		return false
+	}
+
 	data := pow.InitializeData(pow.Block.Nonce)
 
 	hash := sha256.Sum256(data)
+	if bytes.Compare(hash[:], pow.Block.Hash) != 0 {
+		return false
+	}
 	intHash.SetBytes(hash[:])
 
 	return intHash.Cmp(pow.Target) == -1
@@ -71,27 +114,156 @@ func ToHex(num int64) []byte {
 	return buff.Bytes()
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+//Run searches for a nonce up to MaxNonce that puts the header hash below the target. The nonce space is split across
+//MiningWorkers goroutines, worker i of n trying nonces i, i+n, i+2n and so on.
+//It gives up with ctx.Err() as soon as ctx is cancelled, for example because a competing block arrived, and with
+//ErrNonceSpaceExhausted if no nonce works
+func (pow *ProofOfWork) Run(ctx context.Context) (uint32, []byte, error) {
+	workers := MiningWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	search, stop := context.WithCancel(ctx)
+	defer stop()
+
+	type solution struct {
+		nonce uint32
+		hash  []byte
+	}
+	found := make(chan solution, workers)
+	var hashes uint64
+	var wg sync.WaitGroup
+
+	//Only the nonce at the end of the header changes, so each worker writes it into its own copy of the rest
+	prefix := pow.InitializeData(0)
+	prefix = prefix[:len(prefix)-8]
+
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		//The nonce is counted in 64 bits, so the last step past MaxNonce doesn't wrap around to 0
+		go func(nonce uint64) {
+			defer wg.Done()
 
-	nonce := 0
+			var intHash big.Int
+			data := make([]byte, len(prefix)+8)
+			copy(data, prefix)
+			count := uint64(0)
+			defer func() { atomic.AddUint64(&hashes, count) }()
 
-	for nonce < math.MaxInt64 {
-		data := pow.InitializeData(nonce)
-		hash = sha256.Sum256(data)
+			for ; nonce <= MaxNonce; nonce += uint64(workers) {
+				if count%checkInterval == 0 {
+					atomic.AddUint64(&hashes, count)
+					count = 0
+					if search.Err() != nil {
+						return
+					}
+				}
 
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
+				binary.BigEndian.PutUint64(data[len(prefix):], nonce)
+				hash := sha256.Sum256(data)
+				count++
+
+				intHash.SetBytes(hash[:])
+				if intHash.Cmp(pow.Target) == -1 {
+					found <- solution{uint32(nonce), hash[:]}
+					stop()
+					return
+				}
+			}
+		}(uint64(w))
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	var progress <-chan time.Time
+	if MiningProgress != nil {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		progress = ticker.C
+	}
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+	for {
+		select {
+		case <-progress:
+			elapsed := time.Since(start)
+			fmt.Fprintf(MiningProgress, "\rMining block %d: %d hashes, %.0f hashes/s", pow.Block.Height,
+				atomic.LoadUint64(&hashes), float64(atomic.LoadUint64(&hashes))/elapsed.Seconds())
+		case <-finished:
+			pow.Hashes = atomic.LoadUint64(&hashes)
+			pow.Elapsed = time.Since(start)
+
+			select {
+			case s := <-found:
+				if MiningProgress != nil {
+					fmt.Fprintf(MiningProgress, "\r%x\nMined block %d in %s at %.0f hashes/s\n", s.hash, pow.Block.Height,
+						pow.Elapsed.Round(time.Millisecond), pow.HashRate())
+				}
+				return s.nonce, s.hash, nil
+			default:
+			}
+
+			if MiningProgress != nil {
+				fmt.Fprintln(MiningProgress)
+			}
+			if err := ctx.Err(); err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, ErrNonceSpaceExhausted
 		}
 	}
+}
+
+//HashRate is the number of hashes per second the last Run managed
+func (pow *ProofOfWork) HashRate() float64 {
+	if pow.Elapsed <= 0 {
+		return 0
+	}
+	return float64(pow.Hashes) / pow.Elapsed.Seconds()
+}
+
+//ProofOfWorkEngine seals blocks by mining them, at the difficulty NextDifficulty sets
+type ProofOfWorkEngine struct{}
+
+func (ProofOfWorkEngine) Name() string {
+	return ConsensusProofOfWork
+}
+
+func (ProofOfWorkEngine) Prepare(chain *BlockChain, block *Block) error {
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	//Blocks mined within a second of each other would otherwise not get past the median time
+	medianTime, err := chain.MedianTimePast(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= medianTime {
+		block.Timestamp = medianTime + 1
+	}
 
-	fmt.Println()
+	block.Bits, err = chain.NextDifficulty(&parent)
+	return err
+}
 
-	return nonce, hash[:]
+func (ProofOfWorkEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	return block.Mine(ctx)
+}
+
+func (ProofOfWorkEngine) VerifyHeader(chain *BlockChain, block *Block) error {
+	bits, err := chain.ExpectedDifficulty(block)
+	if err != nil {
+		return blockError(block, ErrUnknownParent, "%s", err)
+	}
+	if !NewProof(block).Validate(bits) {
+		return blockError(block, ErrBadProofOfWork, "")
+	}
+	return chain.checkBlockTime(block)
 }
@@ -0,0 +1,87 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newProofBlock(t *testing.T, bits int) *Block {
+	t.Helper()
+	coinbase, err := CoinbaseTx(address(newWallet(t)), "proof test", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBlock([]*Transaction{coinbase}, make([]byte, 32), 1, bits)
+}
+
+//Split across any number of workers, the search finds a nonce that meets the target, and on a single worker it is
+//the lowest one
+func TestRunWorkers(t *testing.T) {
+	defer func(workers int) { MiningWorkers = workers }(MiningWorkers)
+
+	block := newProofBlock(t, 12)
+	pow := NewProof(block)
+
+	lowest := uint32(0)
+	for ; ; lowest++ {
+		hash := sha256.Sum256(pow.InitializeData(lowest))
+		if new(big.Int).SetBytes(hash[:]).Cmp(pow.Target) == -1 {
+			break
+		}
+	}
+
+	for _, workers := range []int{0, 1, 2, 3, 8} {
+		MiningWorkers = workers
+		nonce, hash, err := pow.Run(context.Background())
+		if err != nil {
+			t.Fatalf("%d workers: %s", workers, err)
+		}
+
+		found := *block
+		found.Nonce, found.Hash = nonce, hash
+		if !NewProof(&found).Validate(12) {
+			t.Errorf("%d workers: nonce %d gives %x, which doesn't meet the target", workers, nonce, hash)
+		}
+		if workers <= 1 && nonce != lowest {
+			t.Errorf("%d workers: found nonce %d, the lowest is %d", workers, nonce, lowest)
+		}
+		if pow.Hashes == 0 {
+			t.Errorf("%d workers: no hashes counted", workers)
+		}
+	}
+}
+
+//A search that can't succeed stops as soon as its context is cancelled
+func TestRunCancelled(t *testing.T) {
+	defer func(workers int) { MiningWorkers = workers }(MiningWorkers)
+	MiningWorkers = 4
+
+	block := newProofBlock(t, 200)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := NewProof(block).Run(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("already cancelled: got %v, want %v", err, context.Canceled)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	nonce, hash, err := NewProof(block).Run(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || nonce != 0 || hash != nil {
+		t.Errorf("timed out: got %d %x %v, want %v", nonce, hash, err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %s to stop", elapsed)
+	}
+
+	before := append([]byte{}, block.Hash...)
+	if err := block.Mine(ctx); !errors.Is(err, context.DeadlineExceeded) || !bytes.Equal(block.Hash, before) {
+		t.Errorf("mining with a finished context: got %v, hash %x", err, block.Hash)
+	}
+}
@@ -0,0 +1,244 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StakeSlotTime = 10     //Seconds in a proof of stake slot, each of which has one validator
+	maxSlotSearch = 100000 //Slots Seal looks ahead for one its signer is picked for
+)
+
+var (
+	ErrNoStake = errors.New("signer has no stake")
+)
+
+//Stake is what one owner has in unspent outputs
+type Stake struct {
+	PubKeyHash []byte
+	Value      int
+}
+
+//ProofOfStakeEngine lets the owners of unspent outputs take turns signing blocks, instead of mining them.
+//Time is cut into slots of StakeSlotTime seconds, and each slot after a block's parent has one validator allowed to
+//sign a block in it, picked at random from the owners of the UTXOs at the parent with odds in proportion to their
+//value. The pick is seeded with the parent's hash and the slot, so every node picks the same validator.
+//Blocks have no difficulty, so their Bits are 0 and the branch with the most blocks wins a fork
+type ProofOfStakeEngine struct{}
+
+func (ProofOfStakeEngine) Name() string {
+	return ConsensusProofOfStake
+}
+
+func (ProofOfStakeEngine) Prepare(chain *BlockChain, block *Block) error {
+	if chain.Signer == nil {
+		return ErrNoSigner
+	}
+
+	block.Bits = 0
+	block.Signer = chain.Signer.PublicKey
+	return nil
+}
+
+//Seal waits for the next slot the chain's Signer is picked for, and signs the block in it
+func (ProofOfStakeEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	if chain.Signer == nil {
+		return ErrNoSigner
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	stakes, total, err := chain.Stakes(parent.Hash)
+	if err != nil {
+		return err
+	}
+	signer := wallet.PublicKeyHash(chain.Signer.PublicKey)
+
+	first := parent.Timestamp/StakeSlotTime + 1
+	if now := time.Now().Unix() / StakeSlotTime; now > first {
+		first = now
+	}
+
+	for slot := first; slot < first+maxSlotSearch; slot++ {
+		if bytes.Compare(pickValidator(stakes, total, parent.Hash, slot), signer) != 0 {
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(time.Unix(slot*StakeSlotTime, 0)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		block.Timestamp = slot * StakeSlotTime
+		block.Nonce = 0
+		block.Hash = block.HeaderHash()
+
+		return signBlock(block, chain.Signer)
+	}
+
+	return fmt.Errorf("%w: not picked in the next %d slots", ErrNoStake, maxSlotSearch)
+}
+
+func (ProofOfStakeEngine) VerifyHeader(chain *BlockChain, block *Block) error {
+	if block.Bits != 0 {
+		return blockError(block, ErrBadSeal, "signed block has bits %d", block.Bits)
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return blockError(block, ErrUnknownParent, "%x", block.PrevHash)
+	}
+
+	slot := block.Timestamp / StakeSlotTime
+	if slot <= parent.Timestamp/StakeSlotTime {
+		return blockError(block, ErrBadSeal, "slot %d is not after its parent's", slot)
+	}
+	if block.Timestamp > time.Now().Add(MaxFutureBlockTime).Unix() {
+		return blockError(block, ErrBadSeal, "timestamp is in the future")
+	}
+
+	stakes, total, err := chain.Stakes(parent.Hash)
+	if err != nil {
+		return err
+	}
+	picked := pickValidator(stakes, total, parent.Hash, slot)
+	if bytes.Compare(picked, wallet.PublicKeyHash(block.Signer)) != 0 {
+		return blockError(block, ErrBadSeal, "slot %d belongs to %x", slot, picked)
+	}
+
+	if bytes.Compare(block.Hash, block.HeaderHash()) != 0 || !verifyBlockSignature(block) {
+		return blockError(block, ErrBadSeal, "signature is not valid")
+	}
+
+	return nil
+}
+
+//stakeCache keeps the stakes as of every block Stakes has worked them out for, and the outputs unspent as of the
+//last of them. The stakes of the blocks after it are worked out from there instead of from the genesis block, so
+//verifying a chain block by block doesn't replay it for each one
+type stakeCache struct {
+	mutex   sync.Mutex
+	stakes  map[string]stakesAt //Block hash to the stakes as of that block
+	tip     []byte              //Block the unspent outputs are as of
+	unspent map[string]TxOutput //Outpoint to output
+}
+
+type stakesAt struct {
+	stakes []Stake
+	total  int
+}
+
+//Stakes adds up the outputs that are unspent as of the given block by owner, ordered by public key hash.
+//It works for blocks off the best chain too, by going along the block's branch
+func (chain *BlockChain) Stakes(blockHash []byte) ([]Stake, int, error) {
+	cache := &chain.stakes
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if cached, ok := cache.stakes[string(blockHash)]; ok {
+		return cached.stakes, cached.total, nil
+	}
+
+	//The blocks after the one the unspent outputs are as of, or the whole branch if that one isn't on it
+	var branch []*Block
+	fromGenesis := false
+	iter := &BlockChainIterator{blockHash, chain.Database}
+	for cache.unspent == nil || bytes.Compare(iter.CurrentHash, cache.tip) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		branch = append(branch, block)
+
+		if len(block.PrevHash) == 0 {
+			fromGenesis = true
+			break
+		}
+	}
+
+	if fromGenesis {
+		cache.unspent = make(map[string]TxOutput)
+	}
+	if cache.stakes == nil {
+		cache.stakes = make(map[string]stakesAt)
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		block := branch[i]
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					delete(cache.unspent, outpoint(in))
+				}
+			}
+			for outIdx, out := range tx.Outputs {
+				cache.unspent[fmt.Sprintf("%x:%d", tx.ID, outIdx)] = out
+			}
+		}
+
+		cache.tip = block.Hash
+		cache.stakes[string(block.Hash)] = sumStakes(cache.unspent)
+	}
+
+	cached := cache.stakes[string(blockHash)]
+	return cached.stakes, cached.total, nil
+}
+
+//sumStakes adds up the unspent outputs by owner
+func sumStakes(unspent map[string]TxOutput) stakesAt {
+	owned := make(map[string]int)
+	for _, out := range unspent {
+		owned[hex.EncodeToString(out.PubKeyHash)] += out.Value
+	}
+
+	var stakes []Stake
+	total := 0
+	for owner, value := range owned {
+		if value <= 0 {
+			continue
+		}
+		pubKeyHash, _ := hex.DecodeString(owner)
+		stakes = append(stakes, Stake{pubKeyHash, value})
+		total += value
+	}
+	sort.Slice(stakes, func(i, j int) bool {
+		return bytes.Compare(stakes[i].PubKeyHash, stakes[j].PubKeyHash) < 0
+	})
+
+	return stakesAt{stakes, total}
+}
+
+//pickValidator picks the owner of the stake that a random point in [0, total) falls on, seeded with the parent and slot
+func pickValidator(stakes []Stake, total int, parentHash []byte, slot int64) []byte {
+	if total == 0 {
+		return nil
+	}
+
+	seed := sha256.Sum256(append(append([]byte{}, parentHash...), ToHex(slot)...))
+	point := new(big.Int).Mod(new(big.Int).SetBytes(seed[:]), big.NewInt(int64(total))).Int64()
+
+	for _, stake := range stakes {
+		point -= int64(stake.Value)
+		if point < 0 {
+			return stake.PubKeyHash
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package blockchain
+
+import (
+	"reflect"
+	"testing"
+)
+
+//Stakes worked out from a cache left at another block, on the same branch or another one, have to be the ones
+//worked out from the genesis block
+func TestStakesCache(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	first := mineOn(t, chain, genesis, other, send(t, chain, owner, other, 30))
+	second := mineOn(t, chain, first, owner, send(t, chain, other, owner, 120))
+	tip := mineOn(t, chain, second, other)
+	side := mineOn(t, chain, first, owner)
+
+	//Out of order, and back and forth between the branches
+	for _, block := range []*Block{tip, first, side, second, genesis, tip, side} {
+		stakes, total, err := chain.Stakes(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uncached := &BlockChain{LastHash: chain.LastHash, Database: chain.Database, Engine: chain.Engine}
+		wantStakes, wantTotal, err := uncached.Stakes(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != wantTotal || !reflect.DeepEqual(stakes, wantStakes) {
+			t.Errorf("stakes at height %d are %v of %d, want %v of %d", block.Height, stakes, total, wantStakes, wantTotal)
+		}
+		if wantTotal != (block.Height+1)*100 {
+			t.Errorf("stakes at height %d add up to %d, want %d", block.Height, wantTotal, (block.Height+1)*100)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrCorrupt  = errors.New("data does not decode")
+)
+
+//Reader is what the chain needs to look records up, both from a Store and from inside a Batch
+type Reader interface {
+	//Get returns a copy of the value stored under key, or ErrNotFound
+	Get(key []byte) ([]byte, error)
+}
+
+//Batch is a set of changes made inside Store.Update. Its Get sees the changes made to it so far, and none of them are
+//seen by anyone else until the batch is committed
+type Batch interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+}
+
+//Store is the key value database the chain keeps its blocks, UTXO set and other records in
+type Store interface {
+	Reader
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	//Iterate calls fn with a copy of every key starting with prefix and its value, in key order, until fn returns an error
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+
+	//Update runs fn with a Batch and commits its changes all at once if fn returns nil, or drops them if it doesn't
+	Update(fn func(batch Batch) error) error
+
+	Close() error
+}
+
+//BadgerStore keeps the chain on disk in a BadgerDB directory
+type BadgerStore struct {
+	db *badger.DB
+}
+
+type badgerBatch struct {
+	txn *badger.Txn
+}
+
+//OpenBadgerStore opens or creates the BadgerDB in dir
+func OpenBadgerStore(dir string) (*BadgerStore, error) {
+	db, err := openDB(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerStore{db}, nil
+}
+
+func (s *BadgerStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerGet(txn, key)
+		return err
+	})
+	return value, err
+}
+
+func (s *BadgerStore) Put(key, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (s *BadgerStore) Delete(key []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+func (s *BadgerStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStore) Update(fn func(batch Batch) error) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerBatch{txn})
+	})
+}
+
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+func (b badgerBatch) Get(key []byte) ([]byte, error) {
+	return badgerGet(b.txn, key)
+}
+
+func (b badgerBatch) Put(key, value []byte) error {
+	return b.txn.Set(key, value)
+}
+
+func (b badgerBatch) Delete(key []byte) error {
+	return b.txn.Delete(key)
+}
+
+func badgerGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+//retry removes a stale LOCK file left behind by a node that was killed, and tries to open the database again
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
+
+func openDB(dir string) (*badger.DB, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("database unlocked, value log truncated")
+				return db, nil
+			}
+			log.Println("could not unlock database:", err)
+		}
+		return nil, err
+	} else {
+		return db, nil
+	}
+}
+
+//MemoryStore keeps the chain in a map, for tests and throwaway chains. Everything is lost when it is closed
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	updates sync.Mutex //Lets one Update run at a time, like a database transaction would
+	data    map[string][]byte
+}
+
+type memoryBatch struct {
+	store   *MemoryStore
+	pending map[string][]byte //Nil for keys deleted in the batch
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key []byte) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	value, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *MemoryStore) Put(key, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(key []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.data, string(key))
+	return nil
+}
+
+//Iterate works on a snapshot of the matching records, so fn is free to change the store
+func (s *MemoryStore) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	s.mutex.RLock()
+	var keys []string
+	for key := range s.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = append([]byte{}, s.data[key]...)
+	}
+	s.mutex.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Update(fn func(batch Batch) error) error {
+	s.updates.Lock()
+	defer s.updates.Unlock()
+
+	batch := &memoryBatch{s, make(map[string][]byte)}
+	if err := fn(batch); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, value := range batch.pending {
+		if value == nil {
+			delete(s.data, key)
+		} else {
+			s.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data = make(map[string][]byte)
+	return nil
+}
+
+func (b *memoryBatch) Get(key []byte) ([]byte, error) {
+	if value, ok := b.pending[string(key)]; ok {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return append([]byte{}, value...), nil
+	}
+	return b.store.Get(key)
+}
+
+func (b *memoryBatch) Put(key, value []byte) error {
+	//A non-nil empty slice, so an empty value isn't taken for a delete
+	b.pending[string(key)] = append(make([]byte, 0, len(value)), value...)
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	b.pending[string(key)] = nil
+	return nil
+}
@@ -0,0 +1,23 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+)
+
+//BlockSubsidy is the amount of new coin the coinbase of a block at the given height can mint.
+//It starts at the network's Reward and halves every HalvingInterval blocks, until it reaches zero and miners only earn fees
+func BlockSubsidy(height int) int {
+	params := chaincfg.Active
+	return params.Reward >> uint(height/params.HalvingInterval)
+}
+
+//MaxMoney is the most coin there can ever be, what the subsidies of every block add up to. No output, and no sum of
+//outputs, inputs or fees, can be worth more
+func MaxMoney() int {
+	params := chaincfg.Active
+	total := 0
+	for reward := params.Reward; reward > 0; reward >>= 1 {
+		total += reward * params.HalvingInterval
+	}
+	return total
+}
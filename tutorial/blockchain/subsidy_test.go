@@ -0,0 +1,75 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/chaincfg"
+	"errors"
+	"testing"
+)
+
+func TestBlockSubsidy(t *testing.T) {
+	tests := []struct {
+		params *chaincfg.ChainParams
+		height int
+		want   int
+	}{
+		{&chaincfg.RegTest, 0, 100},
+		{&chaincfg.RegTest, 149, 100},
+		{&chaincfg.RegTest, 150, 50},
+		{&chaincfg.RegTest, 299, 50},
+		{&chaincfg.RegTest, 300, 25},
+		{&chaincfg.RegTest, 150 * 6, 1},
+		{&chaincfg.RegTest, 150 * 7, 0},
+		{&chaincfg.RegTest, 150 * 100, 0},
+		{&chaincfg.MainNet, 209, 100},
+		{&chaincfg.MainNet, 210, 50},
+	}
+
+	defer func() { chaincfg.Active = &chaincfg.RegTest }()
+	for _, test := range tests {
+		chaincfg.Active = test.params
+		if got := BlockSubsidy(test.height); got != test.want {
+			t.Errorf("%s at height %d: got %d, want %d", test.params.Name, test.height, got, test.want)
+		}
+	}
+
+	chaincfg.Active = &chaincfg.RegTest
+	if got, want := MaxMoney(), (100+50+25+12+6+3+1)*150; got != want {
+		t.Errorf("regtest money supply is %d, want %d", got, want)
+	}
+}
+
+//A coinbase can pay up to the subsidy at its height plus the fees of the block's transactions, and no more
+func TestCoinbaseValue(t *testing.T) {
+	owner, miner := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	chaincfg.Active.HalvingInterval = 2
+	genesis := getBlockT(t, chain, chain.LastHash)
+	parent := mineOn(t, chain, genesis, miner)
+
+	tests := []struct {
+		name  string
+		value int //Paid by the coinbase of the block at height 2, where the subsidy is 50, with 7 in fees
+		want  error
+	}{
+		{"subsidy plus fees", 57, nil},
+		{"less than allowed", 10, nil},
+		{"fees left out", 50, nil},
+		{"one over", 58, ErrBadCoinbaseValue},
+		{"subsidy before the halving", 107, ErrBadCoinbaseValue},
+	}
+
+	for _, test := range tests {
+		tx, err := NewTransaction(owner, address(miner), 30, 7, 0, &UTXOSet{chain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := newTestBlock(t, chain, parent, miner, func(b *Block) {
+			b.Transactions[0].Outputs[0].Value = test.value
+			b.Transactions[0].SetID()
+			b.MerkleRoot = b.HashTransactions()
+		}, tx)
+		if err := chain.ValidateBlock(block); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -2,21 +2,24 @@ package blockchain
 
 import (
 	"GolangBlockchain/tutorial/wallet"
-	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 )
 
 const (
-	ErrorPreviousTransactionNotExist = "ERROR: Previous transaction is not correct"
+	sigPartLength = 32 //Bytes in each of r and s in a signature
+)
+
+var (
+	ErrPreviousTransactionNotExist = errors.New("previous transaction is not correct")
+	ErrNotEnoughFunds              = errors.New("not enough funds")
 )
 
 type Transaction struct {
@@ -26,15 +29,22 @@ type Transaction struct {
 }
 
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-	if err := enc.Encode(tx); err != nil {
-		log.Panic(err)
+	var e Encoder
+	encodeTransaction(&e, &tx)
+	return e.Bytes()
+}
+
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	d := NewDecoder(data)
+	transaction := decodeTransaction(d)
+	if err := d.Finish("transaction"); err != nil {
+		return Transaction{}, err
 	}
 
-	return encoded.Bytes()
+	return transaction, nil
 }
 
+//Hash is the sha256 of the transaction's encoding with its ID left empty
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
@@ -46,48 +56,84 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-func CoinbaseTx(to, data string) *Transaction {
+//unsigned is the transaction as it was before it was signed, which is what its ID is the Hash of. The ID is given
+//first, so the signatures aren't part of it. A coinbase isn't signed, its input's Signature carries the extra nonce
+//and is kept
+func (tx *Transaction) unsigned() *Transaction {
+	if tx.IsCoinbase() {
+		return tx
+	}
+
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		in.Signature = nil
+		txCopy.Inputs[i] = in
+	}
+
+	return &txCopy
+}
+
+//CoinbaseTx mints value to the address. Miners pay themselves the block subsidy plus the fees of the block's transactions
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		randData := make([]byte, 24) //Random data keeps coinbase transactions to the same address from sharing an ID
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("%x", randData)
 	}
 
 	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTxOutput(100, to) //The reward for mining the coinbase
+	txout, err := NewTxOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
 	tx.SetID()
 
-	return &tx
+	return &tx, nil
 }
 
 func (tx *Transaction) SetID() {
-	var encoded bytes.Buffer
-	var hash [32]byte
+	tx.ID = tx.unsigned().Hash()
+}
+
+//IncrementExtraNonce gives a coinbase a new ID by counting up the extra nonce it carries in its input's Signature,
+//which a coinbase has no other use for. Miners use it to get a new merkle root once they run out of nonces
+func (tx *Transaction) IncrementExtraNonce() {
+	in := &tx.Inputs[0]
 
-	encode := gob.NewEncoder(&encoded)
-	if err := encode.Encode(tx); err != nil {
-		log.Panic(err)
+	extraNonce := uint64(0)
+	if len(in.Signature) == 8 {
+		extraNonce = binary.BigEndian.Uint64(in.Signature)
 	}
+	in.Signature = make([]byte, 8)
+	binary.BigEndian.PutUint64(in.Signature, extraNonce+1)
 
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hash[:]
+	tx.ID = nil
+	tx.SetID()
 }
 
 func (tx *Transaction) IsCoinbase() bool {
-	singleInput := len(tx.Inputs) == 1
+	if len(tx.Inputs) != 1 {
+		return false
+	}
 	noInputID := len(tx.Inputs[0].ID) == 0
 	inputOutIsNegative := tx.Inputs[0].Out == -1
-	return singleInput && noInputID && inputOutIsNegative
+	return noInputID && inputOutIsNegative
 }
 
-func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, previousTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, previousTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	for _, in := range tx.Inputs {
-		if previousTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic(ErrorPreviousTransactionNotExist)
+		previous := previousTXs[hex.EncodeToString(in.ID)]
+		if previous.ID == nil || in.Out < 0 || in.Out >= len(previous.Outputs) {
+			return fmt.Errorf("%w: %x:%d", ErrPreviousTransactionNotExist, in.ID, in.Out)
 		}
 	}
 
@@ -102,12 +148,18 @@ func (tx *Transaction) Sign(privateKey ecdsa.PrivateKey, previousTXs map[string]
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privateKey, txCopy.ID)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+
+		//r and s are padded, so the signature always splits in half
+		signature := make([]byte, 2*sigPartLength)
+		r.FillBytes(signature[:sigPartLength])
+		s.FillBytes(signature[sigPartLength:])
 
 		tx.Inputs[inId].Signature = signature
 	}
+
+	return nil
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -125,42 +177,39 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return Transaction{tx.ID, inputs, outputs}
 }
 
+//Verify checks the signature of every input against the output it spends, which has to be in previousTXs
 func (tx *Transaction) Verify(previousTXs map[string]Transaction) bool {
+	return tx.verify(previousTXs, false)
+}
+
+//verify is Verify, for a transaction of a version 1 block if legacy is set
+func (tx *Transaction) verify(previousTXs map[string]Transaction, legacy bool) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
 	for _, in := range tx.Inputs {
-		if previousTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic(ErrorPreviousTransactionNotExist)
+		previous := previousTXs[hex.EncodeToString(in.ID)]
+		if previous.ID == nil || in.Out < 0 || in.Out >= len(previous.Outputs) {
+			return false
 		}
 	}
 
+	sigHash, checkSignature := (*Transaction).Hash, verifySignature
+	if legacy {
+		sigHash, checkSignature = (*Transaction).legacyHash, verifyLegacySignature
+	}
+
 	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
 
 	for inId, in := range tx.Inputs {
 		previousTransaction := previousTXs[hex.EncodeToString(in.ID)]
 		txCopy.Inputs[inId].Signature = nil
 		txCopy.Inputs[inId].PubKey = previousTransaction.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
+		txCopy.ID = sigHash(&txCopy)
 		txCopy.Inputs[inId].PubKey = nil
 
-		//Unpack all the data
-		r := big.Int{}
-		s := big.Int{}
-		signatureLength := len(in.Signature)
-		r.SetBytes(in.Signature[:(signatureLength / 2)])
-		s.SetBytes(in.Signature[(signatureLength / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLength := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLength / 2)])
-		y.SetBytes(in.PubKey[(keyLength / 2):])
-
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
+		if checkSignature(in, txCopy.ID) == false {
 			return false
 		}
 	}
@@ -168,6 +217,23 @@ func (tx *Transaction) Verify(previousTXs map[string]Transaction) bool {
 	return true
 }
 
+//verifySignature checks that the input's signature of hash was made with its public key
+func verifySignature(in TxInput, hash []byte) bool {
+	//Unpack all the data
+	if len(in.Signature) != 2*sigPartLength {
+		return false
+	}
+	r := new(big.Int).SetBytes(in.Signature[:sigPartLength])
+	s := new(big.Int).SetBytes(in.Signature[sigPartLength:])
+
+	rawPubKey, err := wallet.ParsePublicKey(in.PubKey)
+	if err != nil {
+		return false
+	}
+
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
+
 func (tx Transaction) String() string {
 	var lines []string
 
@@ -189,27 +255,29 @@ func (tx Transaction) String() string {
 	return strings.Join(lines, "\n")
 }
 
-func NewTransaction(from, to string, amount int, UTXO *UTXOSet) *Transaction {
+//NewTransaction pays amount to the address and sends the change back to the wallet, minus the fee left for the miner.
+//The fee is the given fee plus feeRate for every 1000 bytes of the transaction
+//It returns an error wrapping ErrNotEnoughFunds if the wallet can't cover the amount and the fee
+func NewTransaction(w *wallet.Wallet, to string, amount, fee, feeRate int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	wallets, err := wallet.CreateWallets()
-	if err != nil {
-		log.Panic(err)
-	}
-	w := wallets.GetWallet(from)
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	accumulator, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	accumulator, sizeFee, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee, feeRate)
+	if err != nil {
+		return nil, err
+	}
+	fee += sizeFee
 
-	if accumulator < amount {
-		log.Panic("Error: not enough funds")
+	if accumulator < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrNotEnoughFunds, accumulator, amount+fee)
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 
 		for _, out := range outs {
@@ -218,14 +286,26 @@ func NewTransaction(from, to string, amount int, UTXO *UTXOSet) *Transaction {
 		}
 	}
 
-	outputs = append(outputs, *NewTxOutput(amount, to))
-	if accumulator > amount {
-		outputs = append(outputs, *NewTxOutput(accumulator-amount, from))
+	from := string(w.Address())
+
+	paid, err := NewTxOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *paid)
+	if accumulator > amount+fee {
+		change, err := NewTxOutput(accumulator-amount-fee, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	}
 
 	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey)
+	tx.SetID()
+	if err := UTXO.BlockChain.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
 
-	return &tx
+	return &tx, nil
 }
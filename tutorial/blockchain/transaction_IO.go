@@ -3,8 +3,6 @@ package blockchain
 import (
 	"GolangBlockchain/tutorial/wallet"
 	"bytes"
-	"encoding/gob"
-	"log"
 )
 
 type TxOutput struct {
@@ -28,37 +26,40 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+//Lock sets the output to be spendable by the owner of the address, or returns wallet.ErrInvalidAddress
+func (out *TxOutput) Lock(address []byte) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(string(address))
+	if err != nil {
+		return err
+	}
 	out.PubKeyHash = pubKeyHash
+	return nil
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
-func NewTxOutput(value int, address string) *TxOutput {
+func NewTxOutput(value int, address string) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
 
-	return txo
+	return txo, nil
 }
 
 func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	if err := encode.Encode(outs); err != nil {
-		log.Panic(err)
-	}
-	return buffer.Bytes()
+	var e Encoder
+	encodeOutputs(&e, outs)
+	return e.Bytes()
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	if err := decode.Decode(&outputs); err != nil {
-		log.Panic(err)
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
+	d := NewDecoder(data)
+	outputs := decodeOutputs(d)
+	if err := d.Finish("outputs"); err != nil {
+		return TxOutputs{}, err
 	}
-	return outputs
+	return outputs, nil
 }
@@ -0,0 +1,114 @@
+package blockchain
+
+import (
+	"fmt"
+)
+
+var (
+	txIndexPrefix = []byte("tx-")
+	txIndexKey    = []byte("txindex") //Set once the transaction index covers the whole best chain
+)
+
+//TxLocation is where a transaction on the best chain is, as kept in the transaction index
+type TxLocation struct {
+	BlockHash []byte
+	Index     int //Position of the transaction in the block
+}
+
+func (location TxLocation) Serialize() []byte {
+	var e Encoder
+	encodeTxLocation(&e, location)
+	return e.Bytes()
+}
+
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	d := NewDecoder(data)
+	location := decodeTxLocation(d)
+	if err := d.Finish("tx location"); err != nil {
+		return TxLocation{}, err
+	}
+	return location, nil
+}
+
+func txIndexEntry(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+//indexTransactions records where each of a block's transactions is, as the block is connected to the best chain
+func indexTransactions(batch Batch, block *Block) error {
+	for i, tx := range block.Transactions {
+		if err := batch.Put(txIndexEntry(tx.ID), TxLocation{block.Hash, i}.Serialize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//unindexTransactions removes a block's transactions from the index, as the block is disconnected from the best chain
+func unindexTransactions(batch Batch, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := batch.Delete(txIndexEntry(tx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//LocateTransaction looks a transaction on the best chain up in the transaction index.
+//It returns an error wrapping ErrTxNotFound if the transaction isn't there
+func (chain *BlockChain) LocateTransaction(ID []byte) (TxLocation, error) {
+	data, err := chain.Database.Get(txIndexEntry(ID))
+	if err == ErrNotFound {
+		return TxLocation{}, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	} else if err != nil {
+		return TxLocation{}, err
+	}
+
+	return DeserializeTxLocation(data)
+}
+
+//ReindexTransactions rebuilds the transaction index from the blocks of the best chain, and returns how many
+//transactions it indexed
+func (chain *BlockChain) ReindexTransactions() (int, error) {
+	db := chain.Database
+
+	if err := db.Delete(txIndexKey); err != nil {
+		return 0, err
+	}
+	if err := deleteByPrefix(db, txIndexPrefix); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	iterator := chain.Iterator()
+	for {
+		block, err := iterator.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		//A block at a time, so a long chain doesn't have to fit in one database transaction
+		err = db.Update(func(batch Batch) error {
+			return indexTransactions(batch, block)
+		})
+		if err != nil {
+			return 0, err
+		}
+		count += len(block.Transactions)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return count, db.Put(txIndexKey, []byte{1})
+}
+
+//hasTxIndex says whether the transaction index has been built, which it hasn't for chains from before there was one
+func hasTxIndex(db Reader) (bool, error) {
+	_, err := db.Get(txIndexKey)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+//Transactions are found in the blocks of the best chain only, following it through a reorganization and a reindex
+func TestLocateTransaction(t *testing.T) {
+	owner, oldMiner, newMiner := newWallet(t), newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	paid := send(t, chain, owner, oldMiner, 30)
+	oldTip := mineOn(t, chain, genesis, oldMiner, paid)
+	newFirst := mineOn(t, chain, genesis, newMiner)
+
+	check := func(when string, tx *Transaction, want TxLocation, wantErr error) {
+		t.Helper()
+		got, err := chain.LocateTransaction(tx.ID)
+		if !errors.Is(err, wantErr) || !bytes.Equal(got.BlockHash, want.BlockHash) || got.Index != want.Index {
+			t.Errorf("%s: %x is at %x %d, %v, want %x %d, %v", when, tx.ID, got.BlockHash, got.Index, err,
+				want.BlockHash, want.Index, wantErr)
+		}
+	}
+
+	check("before the reorganization", genesis.Transactions[0], TxLocation{genesis.Hash, 0}, nil)
+	check("before the reorganization", paid, TxLocation{oldTip.Hash, 1}, nil)
+	check("before the reorganization", newFirst.Transactions[0], TxLocation{}, ErrTxNotFound)
+
+	newTip := mineOn(t, chain, newFirst, newMiner)
+	for _, when := range []string{"after the reorganization", "after reindexing"} {
+		check(when, genesis.Transactions[0], TxLocation{genesis.Hash, 0}, nil)
+		check(when, paid, TxLocation{}, ErrTxNotFound)
+		check(when, oldTip.Transactions[0], TxLocation{}, ErrTxNotFound)
+		check(when, newFirst.Transactions[0], TxLocation{newFirst.Hash, 0}, nil)
+		check(when, newTip.Transactions[0], TxLocation{newTip.Hash, 0}, nil)
+
+		if count, err := chain.ReindexTransactions(); err != nil || count != 3 {
+			t.Errorf("%s: reindexed %d transactions, %v, want 3", when, count, err)
+		}
+	}
+}
+
+//Blocks used to be kept under their bare hash, so a block whose hash started with another record's prefix went
+//when those records were rebuilt
+func TestBlockKeysKeptApart(t *testing.T) {
+	owner := newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	var hashes [][]byte
+	for _, prefix := range [][]byte{txIndexPrefix, heightPrefix, utxoPrefix, addrPrefix, undoPrefix} {
+		hash := append(append([]byte{}, prefix...), make([]byte, 32-len(prefix))...)
+		block := *genesis
+		block.Hash = hash
+		if err := chain.Database.Put(blockKey(hash), block.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if _, err := chain.ReindexTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ReindexHeights(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (UTXOSet{chain}).Reindex(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range hashes {
+		if _, err := chain.GetBlock(hash); err != nil {
+			t.Errorf("block %q: %s", hash, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package blockchain
+
+var (
+	undoPrefix    = []byte("undo-")
+	invalidPrefix = []byte("invalid-")
+)
+
+//SpentOutput is an output a block took out of the UTXO set, along with the outpoint it was spent from
+type SpentOutput struct {
+	TxID []byte
+	Out  int
+	UTXO UTXO
+}
+
+//BlockUndo holds everything needed to put the UTXO set back the way it was before a block was connected.
+//Spent is in the order connectBlock removed the outputs
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (undo BlockUndo) Serialize() []byte {
+	var e Encoder
+	encodeUndo(&e, undo)
+	return e.Bytes()
+}
+
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+	d := NewDecoder(data)
+	undo := decodeUndo(d)
+	if err := d.Finish("undo"); err != nil {
+		return BlockUndo{}, err
+	}
+	return undo, nil
+}
+
+func undoKey(blockHash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), blockHash...)
+}
+
+func invalidKey(blockHash []byte) []byte {
+	return append(append([]byte{}, invalidPrefix...), blockHash...)
+}
+
+func getUndo(db Reader, blockHash []byte) (BlockUndo, error) {
+	data, err := db.Get(undoKey(blockHash))
+	if err != nil {
+		return BlockUndo{}, err
+	}
+
+	return DeserializeUndo(data)
+}
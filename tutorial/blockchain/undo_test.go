@@ -0,0 +1,144 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+//chainState is everything connecting and disconnecting blocks changes: the tip, the UTXO set, the undo records and
+//the indexes
+func chainState(t *testing.T, chain *BlockChain) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	for _, prefix := range [][]byte{lastHashKey, utxoTipKey, utxoPrefix, addrPrefix, undoPrefix, txIndexPrefix, heightPrefix} {
+		err := chain.Database.Iterate(prefix, func(key, value []byte) error {
+			state[string(key)] = string(value)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state
+}
+
+func compareState(t *testing.T, when string, got, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s: %q is %x, want %x", when, key, got[key], value)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("%s: %q was left behind", when, key)
+		}
+	}
+}
+
+//Disconnecting blocks puts everything back the way it was before they were connected, and connecting them again
+//gives back the same UTXO set, undo records and indexes
+func TestDisconnectReconnect(t *testing.T) {
+	owner, miner := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	states := []map[string]string{chainState(t, chain)}
+	first := mineOn(t, chain, genesis, miner, send(t, chain, owner, miner, 30))
+	states = append(states, chainState(t, chain))
+	spend := send(t, chain, miner, owner, 120) //Takes both of miner's outputs
+	second := mineOn(t, chain, first, miner, spend)
+	states = append(states, chainState(t, chain))
+
+	undo, err := getUndo(chain.Database, second.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := 0
+	for _, out := range undo.Spent {
+		spent += out.UTXO.Output.Value
+	}
+	if len(undo.Spent) != len(spend.Inputs) || spent != 130 {
+		t.Errorf("undo record of block %d has %d outputs worth %d, want %d worth 130", second.Height,
+			len(undo.Spent), spent, len(spend.Inputs))
+	}
+
+	blocks := []*Block{genesis, first, second}
+	for i := len(blocks) - 1; i > 0; i-- {
+		if err := chain.disconnect(blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+		compareState(t, fmt.Sprintf("disconnecting block %d", i), chainState(t, chain), states[i-1])
+		checkUTXOSet(t, chain)
+	}
+	for i := 1; i < len(blocks); i++ {
+		if err := chain.connect(blocks[i]); err != nil {
+			t.Fatal(err)
+		}
+		compareState(t, fmt.Sprintf("connecting block %d again", i), chainState(t, chain), states[i])
+		checkUTXOSet(t, chain)
+	}
+}
+
+func TestRewindTo(t *testing.T) {
+	owner, miner := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	first := mineOn(t, chain, genesis, miner, send(t, chain, owner, miner, 30))
+	atFirst := chainState(t, chain)
+	second := mineOn(t, chain, first, miner, send(t, chain, owner, miner, 20))
+	mineOn(t, chain, second, miner)
+
+	if err := chain.RewindTo(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.RewindTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, first.Hash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash, first.Hash)
+	}
+	compareState(t, "rewinding to block 1", chainState(t, chain), atFirst)
+	if err := chain.RewindTo(-1); !errors.Is(err, ErrGenesisBlock) {
+		t.Errorf("rewinding past the genesis block: got %v, want %v", err, ErrGenesisBlock)
+	}
+}
+
+//An invalidated block on the best chain takes the blocks after it off too, and the chain doesn't go back to them
+func TestInvalidateBlock(t *testing.T) {
+	owner, miner := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+
+	first := mineOn(t, chain, genesis, miner)
+	atFirst := chainState(t, chain)
+	second := mineOn(t, chain, first, miner, send(t, chain, owner, miner, 30))
+	third := mineOn(t, chain, second, miner)
+
+	if err := chain.InvalidateBlock(second.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, first.Hash) {
+		t.Errorf("tip is %x, want %x", chain.LastHash, first.Hash)
+	}
+	compareState(t, "invalidating block 2", chainState(t, chain), atFirst)
+	if invalid, err := chain.IsInvalid(second.Hash); err != nil || !invalid {
+		t.Errorf("block 2 is not marked invalid, %v", err)
+	}
+
+	//Blocks the chain already has are skipped, and one built on them is refused
+	for _, block := range []*Block{second, third} {
+		if err := chain.AddBlock(block); err != nil || !bytes.Equal(chain.LastHash, first.Hash) {
+			t.Errorf("adding block %d again moved the tip to %x, %v", block.Height, chain.LastHash, err)
+		}
+	}
+	if err := chain.AddBlock(newTestBlock(t, chain, third, miner, nil)); !errors.Is(err, ErrInvalidatedBlock) {
+		t.Errorf("adding a block on block 3: got %v, want %v", err, ErrInvalidatedBlock)
+	}
+	if err := chain.InvalidateBlock(genesis.Hash); !errors.Is(err, ErrGenesisBlock) {
+		t.Errorf("invalidating the genesis block: got %v, want %v", err, ErrGenesisBlock)
+	}
+}
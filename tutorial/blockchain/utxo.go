@@ -2,253 +2,452 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/dgraph-io/badger"
-	"log"
+	"sort"
 )
 
 var (
-	utxoPrefix   = []byte("utxo-")
-	prefixLength = len(utxoPrefix)
+	utxoPrefix     = []byte("utxo-")
+	prefixLength   = len(utxoPrefix)
+	utxoVersionKey = []byte("utxoversion") //Set once the UTXO set is kept as one record per output
+	utxoTipKey     = []byte("utxotip")     //Hash of the block the UTXO set and the indexes were last moved to
+)
+
+const (
+	txIDLength = 32 //Transaction IDs are sha256 hashes
+	outLength  = 8  //Length of the output index at the end of an outpoint key
 )
 
 type UTXOSet struct {
 	BlockChain *BlockChain
 }
 
-func (u UTXOSet) Reindex() {
+//UTXO is an unspent output, along with where it was created
+type UTXO struct {
+	Output   TxOutput
+	Height   int  //Height of the block the output was created in
+	Coinbase bool //Whether a coinbase created the output
+}
+
+func (utxo UTXO) Serialize() []byte {
+	var e Encoder
+	encodeUTXO(&e, utxo)
+	return e.Bytes()
+}
+
+func DeserializeUTXO(data []byte) (UTXO, error) {
+	d := NewDecoder(data)
+	utxo := decodeUTXO(d)
+	if err := d.Finish("utxo"); err != nil {
+		return UTXO{}, err
+	}
+	return utxo, nil
+}
+
+//outpointKey is the transaction ID followed by the output's index in the transaction, which never changes however
+//many of the transaction's other outputs are spent
+func outpointKey(txID []byte, out int) []byte {
+	return append(append([]byte{}, txID...), ToHex(int64(out))...)
+}
+
+//splitOutpointKey is the reverse of outpointKey
+func splitOutpointKey(key []byte) ([]byte, int, error) {
+	if len(key) != txIDLength+outLength {
+		return nil, 0, fmt.Errorf("%w: outpoint key %x", ErrCorrupt, key)
+	}
+	return key[:txIDLength], int(binary.BigEndian.Uint64(key[txIDLength:])), nil
+}
+
+func utxoEntry(txID []byte, out int) []byte {
+	return append(append([]byte{}, utxoPrefix...), outpointKey(txID, out)...)
+}
+
+//Reindex rebuilds the UTXO set and the address index from the blocks of the best chain
+func (u UTXOSet) Reindex() error {
 	db := u.BlockChain.Database
 
-	u.DeleteByPrefix(utxoPrefix)
+	//Until the new set is written, it isn't at any block
+	if err := db.Delete(utxoTipKey); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(addrPrefix); err != nil {
+		return err
+	}
 
-	UTXO := u.BlockChain.FindUnspentTransactions()
+	unspent, err := u.BlockChain.FindUnspentTransactions()
+	if err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for txId, outs := range UTXO {
-			key, err := hex.DecodeString(txId)
-			if err != nil {
-				return err
-			}
-			key = append(utxoPrefix, key...)
+	for txId, outs := range unspent {
+		txID, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
+		}
 
-			if err := txn.Set(key, outs.Serialize()); err != nil {
-				log.Panic(err)
+		//A transaction at a time, so a large UTXO set doesn't have to fit in one database transaction
+		err = db.Update(func(batch Batch) error {
+			for out, utxo := range outs {
+				if err := addUTXO(batch, txID, out, utxo); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
+	}
+
+	return db.Update(func(batch Batch) error {
+		if err := batch.Put(utxoVersionKey, []byte{2}); err != nil {
+			return err
+		}
+		if err := batch.Put(addrIndexKey, []byte{addrIndexVersion}); err != nil {
+			return err
+		}
+		return batch.Put(utxoTipKey, u.BlockChain.LastHash)
 	})
+}
+
+//migrate moves a UTXO set kept as one TxOutputs record per transaction over to one record per output.
+//The old records lost the indexes of the outputs left after a spend, so instead of being converted, the set is rebuilt
+//by connecting the best chain's blocks again from the genesis block up, which also writes their undo records again.
+//If a block fails to connect, which it can if it spends an output by the index the old records gave it, the set is
+//rebuilt without undo data instead
+func (u UTXOSet) migrate() error {
+	chain := u.BlockChain
+	db := chain.Database
+
+	for _, prefix := range [][]byte{utxoPrefix, addrPrefix, undoPrefix} {
+		if err := deleteByPrefix(db, prefix); err != nil {
+			return err
+		}
+	}
+
+	bestHeight, err := chain.BestHeight()
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	for height := 0; height <= bestHeight; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+
+		if err := u.Update(&block); errors.Is(err, ErrMissingInput) {
+			fmt.Printf("%s, rebuilding the UTXO set without undo data instead\n", err)
+			if err := deleteByPrefix(db, undoPrefix); err != nil {
+				return err
+			}
+			return u.Reindex()
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := db.Put(addrIndexKey, []byte{addrIndexVersion}); err != nil {
+		return err
 	}
+	return db.Put(utxoVersionKey, []byte{2})
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	db := u.BlockChain.Database
+//hasUTXOVersion says whether the UTXO set is kept as one record per output
+func hasUTXOVersion(db Reader) (bool, error) {
+	_, err := db.Get(utxoVersionKey)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//addUTXO stores an unspent output under its outpoint, and in the address index
+func addUTXO(batch Batch, txID []byte, out int, utxo UTXO) error {
+	if err := batch.Put(utxoEntry(txID, out), utxo.Serialize()); err != nil {
+		return err
+	}
+	return indexOutput(batch, txID, out, utxo.Output)
+}
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					if err != nil {
-						log.Panic(err)
-					}
-
-					var outs []byte
-					err = item.Value(func(val []byte) error {
-						outs = append([]byte{}, val...)
-						return nil
-					})
-					if err != nil {
-						log.Panic(err)
-					}
-
-					deseralizedOuts := DeserializeOutputs(outs)
-
-					for outIdx, out := range deseralizedOuts.Outputs {
-						//If an output hasn't been attached to an input yet, then it is unspent
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
+//removeUTXO deletes an unspent output, and its address index entry
+func removeUTXO(batch Batch, txID []byte, out int, output TxOutput) error {
+	if err := batch.Delete(utxoEntry(txID, out)); err != nil {
+		return err
+	}
+	return unindexOutput(batch, txID, out, output)
+}
+
+//Update connects a block to the UTXO set in a write of its own, without moving the tip of the chain
+func (u *UTXOSet) Update(block *Block) error {
+	return u.BlockChain.Database.Update(func(batch Batch) error {
+		return connectBlock(batch, block)
+	})
+}
+
+//Disconnect reverses Update for a block in a write of its own, without moving the tip of the chain
+func (u *UTXOSet) Disconnect(block *Block) error {
+	return u.BlockChain.Database.Update(func(batch Batch) error {
+		return disconnectBlock(batch, block)
+	})
+}
+
+//connectBlock connects a block to the UTXO set, and stores the outputs it spends as the block's undo record.
+//The block's transactions and height are added to the indexes along with it, and the block becomes the UTXO set's tip
+func connectBlock(batch Batch, block *Block) error {
+	undo := BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				value, err := batch.Get(utxoEntry(in.ID, in.Out))
+				if err == ErrNotFound {
+					return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
+				} else if err != nil {
+					return err
+				}
+
+				spent, err := DeserializeUTXO(value)
+				if err != nil {
+					return err
+				}
+				if err := removeUTXO(batch, in.ID, in.Out, spent.Output); err != nil {
+					return err
 				}
+				undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, spent})
 			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		}
+
+		for out, output := range tx.Outputs {
+			if err := addUTXO(batch, tx.ID, out, UTXO{output, block.Height, tx.IsCoinbase()}); err != nil {
+				return err
 			}
+		}
+	}
+
+	if err := indexTransactions(batch, block); err != nil {
+		return err
+	}
+	if err := indexHeight(batch, block); err != nil {
+		return err
+	}
+	if err := batch.Put(undoKey(block.Hash), undo.Serialize()); err != nil {
+		return err
+	}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+	return batch.Put(utxoTipKey, block.Hash)
+}
+
+//disconnectBlock reverses connectBlock, using the undo record it stored for the block.
+//The outputs the block created are removed and the outputs it spent are put back, and its parent becomes the UTXO set's tip
+func disconnectBlock(batch Batch, block *Block) error {
+	undo, err := getUndo(batch, block.Hash)
+	if err != nil {
+		return fmt.Errorf("no undo data for block %x: %s", block.Hash, err)
+	}
+
+	//Walk everything backwards, so outputs spent in the same block they were created in are restored before being removed
+	spent := len(undo.Spent)
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		for out, output := range tx.Outputs {
+			if err := removeUTXO(batch, tx.ID, out, output); err != nil {
+				return err
 			}
 		}
 
-		return nil
-	})
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			in := tx.Inputs[j]
+			if spent == 0 || bytes.Compare(undo.Spent[spent-1].TxID, in.ID) != 0 || undo.Spent[spent-1].Out != in.Out {
+				return fmt.Errorf("%w: undo data of block %x does not match input %x:%d", ErrCorrupt, block.Hash, in.ID, in.Out)
+			}
+			spent--
+			restored := undo.Spent[spent]
+
+			if err := addUTXO(batch, in.ID, in.Out, restored.UTXO); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := unindexTransactions(batch, block); err != nil {
+		return err
+	}
+	if err := unindexHeight(batch, block); err != nil {
+		return err
+	}
+	if err := batch.Delete(undoKey(block.Hash)); err != nil {
+		return err
+	}
+
+	return batch.Put(utxoTipKey, block.PrevHash)
+}
+
+//hasUTXOTip says whether the UTXO set and the indexes are at the block the tip of the chain points to.
+//They aren't if a write that should have moved them along with the tip never happened, or for chains from before the
+//UTXO set's tip was kept
+func hasUTXOTip(db Reader) (bool, error) {
+	utxoTip, err := db.Get(utxoTipKey)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	lastHash, err := db.Get(lastHashKey)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Compare(utxoTip, lastHash) == 0, nil
+}
+
+//FindUTXO returns the unspent output at an outpoint, and whether it is unspent
+func (u UTXOSet) FindUTXO(txID []byte, out int) (UTXO, bool, error) {
+	value, err := u.BlockChain.Database.Get(utxoEntry(txID, out))
+	if err == ErrNotFound {
+		return UTXO{}, false, nil
+	} else if err != nil {
+		return UTXO{}, false, err
+	}
+
+	utxo, err := DeserializeUTXO(value)
 	if err != nil {
-		log.Panic(err)
+		return UTXO{}, false, err
 	}
+
+	return utxo, true, nil
 }
 
-func (u UTXOSet) CountTransactions() int {
+//CountTransactions counts the transactions with at least one unspent output
+func (u UTXOSet) CountTransactions() (int, error) {
 	db := u.BlockChain.Database
 	counter := 0
+	var last []byte
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+	//Keys are in order, so the outputs of a transaction are next to each other
+	err := db.Iterate(utxoPrefix, func(key, value []byte) error {
+		txID, _, err := splitOutpointKey(key[prefixLength:])
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(txID, last) != 0 {
 			counter++
+			last = txID
 		}
-
 		return nil
 	})
 
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return counter
+	return counter, err
 }
 
 //DeleteByPrefix is a bulk delete of all transactions with a given prefix
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	return deleteByPrefix(u.BlockChain.Database, prefix)
+}
+
+func deleteByPrefix(db Store, prefix []byte) error {
 	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.BlockChain.Database.Update(func(txn *badger.Txn) error {
+		return db.Update(func(batch Batch) error {
 			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
+				if err := batch.Delete(key); err != nil {
 					return err
 				}
 			}
 			return nil
-		}); err != nil {
-			return err
-		}
+		})
+	}
+
+	//Keys are collected first, so none are deleted from under the iteration
+	var keysForDelete [][]byte
+	err := db.Iterate(prefix, func(key, value []byte) error {
+		keysForDelete = append(keysForDelete, key)
 		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	collectSize := 100000 //optimal number dictated by use of BadgerDB
-	u.BlockChain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
+	for start := 0; start < len(keysForDelete); start += collectSize {
+		end := start + collectSize
+		if end > len(keysForDelete) {
+			end = len(keysForDelete)
 		}
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
-			}
+		if err := deleteKeys(keysForDelete[start:end]); err != nil {
+			return err
 		}
-		return nil
-	})
+	}
+
+	return nil
 }
 
-func (u UTXOSet) FindUnspentTransactionOutputs(pubKeyHash []byte) []TxOutput {
+//FindUnspentTransactionOutputs returns the unspent outputs locked to pubKeyHash, found through the address index
+func (u UTXOSet) FindUnspentTransactionOutputs(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
-	db := u.BlockChain.Database
-
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			var outs []byte
-			err := item.Value(func(val []byte) error {
-				outs = append([]byte{}, val...)
-				return nil
-			})
-			if err != nil {
-				log.Panic(err)
-			}
-			deseralizedOuts := DeserializeOutputs(outs)
 
-			for _, out := range deseralizedOuts.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
-		}
-		return nil
+	err := u.ownedOutputs(pubKeyHash, func(txID []byte, out int, utxo UTXO) {
+		UTXOs = append(UTXOs, utxo.Output)
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return UTXOs
+	return UTXOs, nil
 }
 
-//FindSpendableOutputs will enable normal transactions that are not coinbase transactions
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+//FindSpendableOutputs will enable normal transactions that are not coinbase transactions.
+//It picks outputs owned by pubKeyHash worth at least amount plus the fee of spending them at
+//feeRate per 1000 bytes. It spends the largest outputs first, so the transaction needs as few inputs as it can, and
+//skips outputs worth less than the fee of the input spending them. It returns the total picked and the fee
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount, feeRate int) (int, int, map[string][]int, error) {
+	type spendable struct {
+		txID  string
+		index int
+		value int
+	}
+	var candidates []spendable
+
+	err := u.ownedOutputs(pubKeyHash, func(txID []byte, out int, utxo UTXO) {
+		candidates = append(candidates, spendable{hex.EncodeToString(txID), out, utxo.Output.Value})
+	})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].value > candidates[j].value
+	})
+
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
-	db := u.BlockChain.Database
+	inputs := 0
+	fee := FeeForSize(EstimateTxSize(0), feeRate)
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			key := item.Key()
-			var value []byte
-			err := item.Value(func(val []byte) error {
-				value = append([]byte{}, val...)
-				return nil
-			})
-			if err != nil {
-				log.Panic(err)
-			}
-			trimmedKey := bytes.TrimPrefix(key, utxoPrefix)
-			txID := hex.EncodeToString(trimmedKey)
-			outs := DeserializeOutputs(value)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-			}
+	for _, candidate := range candidates {
+		if accumulated >= amount+fee {
+			break
 		}
-		return nil
-	})
-	if err != nil {
-		fmt.Println("error", err)
+
+		inputFee := FeeForSize(EstimateTxSize(inputs+1), feeRate) - FeeForSize(EstimateTxSize(inputs), feeRate)
+		if candidate.value <= inputFee {
+			continue //Costs more to spend than it is worth
+		}
+
+		accumulated += candidate.value
+		fee += inputFee
+		inputs++
+		unspentOuts[candidate.txID] = append(unspentOuts[candidate.txID], candidate.index)
 	}
 
-	return accumulated, unspentOuts
+	return accumulated, fee, unspentOuts, nil
 }
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+//A UTXO set left behind or ahead of the tip, by a write that never happened, is moved to the tip when the chain is
+//opened, or rebuilt if it can't be moved
+func TestRepairUTXOSet(t *testing.T) {
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, chain *BlockChain, tip *Block)
+		atTip  bool //Whether the chain's tip stays at the second block
+	}{
+		{"behind the tip", func(t *testing.T, chain *BlockChain, tip *Block) {
+			if err := (&UTXOSet{chain}).Disconnect(tip); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"ahead of the tip", func(t *testing.T, chain *BlockChain, tip *Block) {
+			if err := chain.Database.Put(lastHashKey, tip.PrevHash); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"ahead of the tip without undo data", func(t *testing.T, chain *BlockChain, tip *Block) {
+			if err := chain.Database.Put(lastHashKey, tip.PrevHash); err != nil {
+				t.Fatal(err)
+			}
+			if err := chain.Database.Delete(undoKey(tip.Hash)); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"at no block", func(t *testing.T, chain *BlockChain, tip *Block) {
+			if err := chain.Database.Delete(utxoTipKey); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+
+	for _, test := range tests {
+		owner, miner := newWallet(t), newWallet(t)
+		chain := newTestChain(t, owner)
+		genesis := getBlockT(t, chain, chain.LastHash)
+		first := mineOn(t, chain, genesis, miner)
+		second := mineOn(t, chain, first, miner, send(t, chain, owner, miner, 30))
+
+		test.damage(t, chain, second)
+		chain, err := LoadBlockChain(chain.Database)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		wantTip, wantOwner, wantMiner := second, 70, 230
+		if !test.atTip {
+			wantTip, wantOwner, wantMiner = first, 100, 100
+		}
+		if utxoTip, err := chain.Database.Get(utxoTipKey); err != nil || !bytes.Equal(utxoTip, wantTip.Hash) {
+			t.Errorf("%s: UTXO set is at %x, %v, want %x", test.name, utxoTip, err, wantTip.Hash)
+		}
+		if got := balance(t, chain, owner); got != wantOwner {
+			t.Errorf("%s: owner has %d, want %d", test.name, got, wantOwner)
+		}
+		if got := balance(t, chain, miner); got != wantMiner {
+			t.Errorf("%s: miner has %d, want %d", test.name, got, wantMiner)
+		}
+		checkUTXOSet(t, chain)
+	}
+}
+
+//A UTXO set kept as one record per transaction is rebuilt with one record per output, along with the undo records
+//that let its blocks be disconnected
+func TestMigrateUTXOSet(t *testing.T) {
+	owner, miner := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+	tip := mineOn(t, chain, genesis, miner, send(t, chain, owner, miner, 30))
+
+	for _, prefix := range [][]byte{utxoPrefix, addrPrefix, undoPrefix} {
+		if err := deleteByPrefix(chain.Database, prefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chain.Database.Delete(utxoVersionKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range tip.Transactions {
+		key := append(append([]byte{}, utxoPrefix...), tx.ID...)
+		if err := chain.Database.Put(key, TxOutputs{tx.Outputs}.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chain, err := LoadBlockChain(chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := hasUTXOVersion(chain.Database); !ok {
+		t.Errorf("UTXO set was not moved, %v", err)
+	}
+	if got := balance(t, chain, owner); got != 70 {
+		t.Errorf("owner has %d, want 70", got)
+	}
+	if got := balance(t, chain, miner); got != 130 {
+		t.Errorf("miner has %d, want 130", got)
+	}
+	checkUTXOSet(t, chain)
+
+	if err := (&UTXOSet{chain}).Disconnect(tip); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(t, chain, owner); got != 100 {
+		t.Errorf("owner has %d after disconnecting block %d, want 100", got, tip.Height)
+	}
+}
@@ -0,0 +1,340 @@
+package blockchain
+
+import (
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	MaxBlockSize = 1 << 20 //Largest a serialized block can be, in bytes
+)
+
+var (
+	ErrBlockTooLarge      = errors.New("block is larger than the maximum block size")
+	ErrNoTransactions     = errors.New("block has no transactions")
+	ErrOldBlockVersion    = errors.New("block version is no longer accepted")
+	ErrInvalidatedBlock   = errors.New("block was invalidated")
+	ErrUnknownParent      = errors.New("previous block is unknown")
+	ErrBadHeight          = errors.New("height does not follow the previous block")
+	ErrBadProofOfWork     = errors.New("proof of work is not valid")
+	ErrBadTimestamp       = errors.New("timestamp is out of range")
+	ErrBadMerkleRoot      = errors.New("merkle root does not match the transactions")
+	ErrBadCoinbase        = errors.New("block must have exactly one coinbase, as its first transaction")
+	ErrBadCoinbaseValue   = errors.New("coinbase pays more than the block subsidy plus fees")
+	ErrDoubleSpend        = errors.New("output is spent more than once in the block")
+	ErrMissingInput       = errors.New("input spends an output that is not unspent")
+	ErrEmptyTransaction   = errors.New("transaction has no inputs or no outputs")
+	ErrBadTxID            = errors.New("transaction ID is not the hash of the transaction")
+	ErrBadPubKeyHash      = errors.New("output is not locked to a public key hash")
+	ErrBadOutputValue     = errors.New("output value is negative or more than the money supply")
+	ErrValueOverflow      = errors.New("values add up to more than the money supply")
+	ErrInputsBelowOutputs = errors.New("outputs are worth more than the inputs")
+	ErrBadSignature       = errors.New("transaction signature is not valid")
+)
+
+//BlockError is returned when a block fails validation. Err is one of the Err* values above, so callers can tell
+//what went wrong with errors.Is
+type BlockError struct {
+	BlockHash []byte
+	Err       error
+	Detail    string
+}
+
+func (e *BlockError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %x: %s", e.BlockHash, e.Err)
+	}
+	return fmt.Sprintf("block %x: %s: %s", e.BlockHash, e.Err, e.Detail)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+func blockError(block *Block, err error, detail string, args ...interface{}) error {
+	return &BlockError{block.Hash, err, fmt.Sprintf(detail, args...)}
+}
+
+//TxError is returned when a transaction fails validation, on its own or as part of a block
+type TxError struct {
+	TxID   []byte
+	Err    error
+	Detail string
+}
+
+func (e *TxError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("transaction %x: %s", e.TxID, e.Err)
+	}
+	return fmt.Sprintf("transaction %x: %s: %s", e.TxID, e.Err, e.Detail)
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+func txError(tx *Transaction, err error, detail string, args ...interface{}) error {
+	return &TxError{tx.ID, err, fmt.Sprintf(detail, args...)}
+}
+
+//blockTxError returns the error a transaction of the block failed validation with as an error of the block. Any other
+//error, like one reading the UTXO set, is returned as it is
+func blockTxError(block *Block, err error) error {
+	var txErr *TxError
+	if !errors.As(err, &txErr) {
+		return err
+	}
+	if txErr.Detail == "" {
+		return blockError(block, txErr.Err, "transaction %x", txErr.TxID)
+	}
+	return blockError(block, txErr.Err, "transaction %x: %s", txErr.TxID, txErr.Detail)
+}
+
+//ValidateBlock runs every check a block has to pass before it is stored.
+//Checks that need the UTXO set can only be run when the block builds on the current tip, otherwise they are left
+//until the block's branch gets connected
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := chain.checkBlock(block); err != nil {
+		return err
+	}
+
+	if bytes.Compare(block.PrevHash, chain.LastHash) == 0 {
+		return chain.checkBlockInputs(block)
+	}
+
+	return nil
+}
+
+//checkBlock covers everything that can be checked from the block and the headers before it
+func (chain *BlockChain) checkBlock(block *Block) error {
+	if len(block.Serialize()) > MaxBlockSize {
+		return blockError(block, ErrBlockTooLarge, "")
+	}
+	if len(block.Transactions) == 0 {
+		return blockError(block, ErrNoTransactions, "")
+	}
+	//Version 1 blocks only come from chains that were migrated, new ones could be used to get transactions past
+	//the ID check with hashes computed over gob
+	if block.Version < BlockVersion {
+		return blockError(block, ErrOldBlockVersion, "version %d", block.Version)
+	}
+	if invalid, err := chain.IsInvalid(block.Hash); err != nil {
+		return err
+	} else if invalid {
+		return blockError(block, ErrInvalidatedBlock, "")
+	}
+
+	if len(block.PrevHash) == 0 {
+		if block.Height != 0 {
+			return blockError(block, ErrBadHeight, "genesis block at height %d", block.Height)
+		}
+		genesis, err := Genesis()
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(block.Hash, genesis.Hash) != 0 {
+			return blockError(block, ErrWrongGenesis, "")
+		}
+	} else {
+		parent, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return blockError(block, ErrUnknownParent, "%x", block.PrevHash)
+		}
+		if invalid, err := chain.IsInvalid(parent.Hash); err != nil {
+			return err
+		} else if invalid {
+			return blockError(block, ErrInvalidatedBlock, "previous block %x was invalidated", parent.Hash)
+		}
+		if block.Height != parent.Height+1 {
+			return blockError(block, ErrBadHeight, "height %d after %d", block.Height, parent.Height)
+		}
+	}
+
+	if err := chain.VerifySeal(block); err != nil {
+		return err
+	}
+
+	if bytes.Compare(block.MerkleRoot, block.HashTransactions()) != 0 {
+		return blockError(block, ErrBadMerkleRoot, "")
+	}
+
+	for i, tx := range block.Transactions {
+		if err := checkTransaction(tx); err != nil {
+			return blockTxError(block, err)
+		}
+		if err := checkTransactionID(tx, isLegacyBlock(block)); err != nil {
+			return blockTxError(block, err)
+		}
+		if tx.IsCoinbase() != (i == 0) {
+			return blockError(block, ErrBadCoinbase, "transaction %d", i)
+		}
+	}
+
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions[1:] {
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+			if spent[outpoint] {
+				return blockError(block, ErrDoubleSpend, outpoint)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+//checkTransaction covers everything that can be checked from the transaction alone, without the chain
+func checkTransaction(tx *Transaction) error {
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return txError(tx, ErrEmptyTransaction, "%d inputs, %d outputs", len(tx.Inputs), len(tx.Outputs))
+	}
+	//The address index keys outputs by their public key hash, and no key hashes to any other length
+	for i, out := range tx.Outputs {
+		if len(out.PubKeyHash) != wallet.PubKeyHashLength {
+			return txError(tx, ErrBadPubKeyHash, "output %d is locked to %d bytes", i, len(out.PubKeyHash))
+		}
+	}
+
+	_, err := outputsValue(tx)
+	return err
+}
+
+//checkTransactionID checks that the transaction's ID is the hash of it unsigned, so that it can't pass for another
+//transaction. legacy is for transactions of version 1 blocks, whose IDs were computed over gob
+func checkTransactionID(tx *Transaction, legacy bool) error {
+	hash := tx.unsigned().Hash()
+	if legacy {
+		hash = tx.unsigned().legacyHash()
+	}
+	if bytes.Compare(tx.ID, hash) != 0 {
+		return txError(tx, ErrBadTxID, "hash is %x", hash)
+	}
+
+	return nil
+}
+
+//outputsValue adds up what the transaction's outputs are worth
+func outputsValue(tx *Transaction) (int, error) {
+	total := 0
+	for i, out := range tx.Outputs {
+		var ok bool
+		if total, ok = addValue(total, out.Value); !ok {
+			if out.Value < 0 || out.Value > MaxMoney() {
+				return 0, txError(tx, ErrBadOutputValue, "output %d is worth %d", i, out.Value)
+			}
+			return 0, txError(tx, ErrValueOverflow, "outputs")
+		}
+	}
+
+	return total, nil
+}
+
+//addValue adds value to total. It fails if value is negative or more than MaxMoney, or if the sum is, which also keeps
+//it from overflowing
+func addValue(total, value int) (int, bool) {
+	if value < 0 || value > MaxMoney() || total > MaxMoney()-value {
+		return total, false
+	}
+	return total + value, true
+}
+
+//checkBlockInputs checks the block's transactions against the UTXO set, which has to be at the block's parent.
+//Transactions may spend outputs of transactions earlier in the same block
+func (chain *BlockChain) checkBlockInputs(block *Block) error {
+	created := make(map[string]Transaction)
+	fees := 0
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			created[hex.EncodeToString(tx.ID)] = *tx
+			continue
+		}
+
+		fee, err := chain.checkTransactionInputs(tx, created, isLegacyBlock(block))
+		if err != nil {
+			return blockTxError(block, err)
+		}
+		var ok bool
+		if fees, ok = addValue(fees, fee); !ok {
+			return blockError(block, ErrValueOverflow, "fees")
+		}
+
+		created[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	coinbaseValue, err := outputsValue(block.Transactions[0])
+	if err != nil {
+		return blockTxError(block, err)
+	}
+	if allowed := BlockSubsidy(block.Height) + fees; coinbaseValue > allowed {
+		return blockError(block, ErrBadCoinbaseValue, "pays %d, allowed %d", coinbaseValue, allowed)
+	}
+
+	return nil
+}
+
+//checkTransactionInputs checks a transaction's inputs against the UTXO set, and against the outputs of the
+//transactions in pending, which aren't in the UTXO set yet. legacy is for transactions of version 1 blocks, whose
+//signatures were made over gob. It returns the fee the transaction pays
+func (chain *BlockChain) checkTransactionInputs(tx *Transaction, pending map[string]Transaction, legacy bool) (int, error) {
+	UTXOSet := UTXOSet{chain}
+
+	outputs, err := outputsValue(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	previousTXs := make(map[string]Transaction)
+	inputs := 0
+	for _, in := range tx.Inputs {
+		inID := hex.EncodeToString(in.ID)
+
+		//The output being spent is the one UTXOSet.Update will remove for this input
+		var spent TxOutput
+		previousTX, ok := pending[inID]
+		if ok {
+			if in.Out < 0 || in.Out >= len(previousTX.Outputs) {
+				return 0, txError(tx, ErrMissingInput, "%x:%d", in.ID, in.Out)
+			}
+			spent = previousTX.Outputs[in.Out]
+		} else {
+			utxo, unspent, err := UTXOSet.FindUTXO(in.ID, in.Out)
+			if err != nil {
+				return 0, err
+			}
+			if !unspent {
+				return 0, txError(tx, ErrMissingInput, "%x:%d", in.ID, in.Out)
+			}
+			spent = utxo.Output
+
+			found, err := chain.FindTransaction(in.ID)
+			if err != nil || in.Out >= len(found.Outputs) {
+				return 0, txError(tx, ErrMissingInput, "%x:%d", in.ID, in.Out)
+			}
+			previousTX = found
+		}
+
+		if !spent.IsLockedWithKey(wallet.PublicKeyHash(in.PubKey)) {
+			return 0, txError(tx, ErrBadSignature, "spends %x:%d with a key that does not own it", in.ID, in.Out)
+		}
+
+		previousTXs[inID] = previousTX
+		if inputs, ok = addValue(inputs, spent.Value); !ok {
+			return 0, txError(tx, ErrValueOverflow, "inputs")
+		}
+	}
+
+	if inputs < outputs {
+		return 0, txError(tx, ErrInputsBelowOutputs, "spends %d of %d", outputs, inputs)
+	}
+
+	if !tx.verify(previousTXs, legacy) {
+		return 0, txError(tx, ErrBadSignature, "")
+	}
+
+	return inputs - outputs, nil
+}
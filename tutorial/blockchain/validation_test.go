@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestValidateBlockRejects(t *testing.T) {
+	owner, other := newWallet(t), newWallet(t)
+	chain := newTestChain(t, owner)
+	genesis := getBlockT(t, chain, chain.LastHash)
+	parent := mineOn(t, chain, genesis, owner)
+
+	//Changes to the transactions have to be followed by a new merkle root, or the block fails on that instead
+	remerkle := func(b *Block) { b.MerkleRoot = b.HashTransactions() }
+
+	tests := []struct {
+		name   string
+		spend  bool //Whether the block pays other from owner
+		change func(b *Block)
+		want   error
+	}{
+		{"valid", true, nil, nil},
+		{"old version", false, func(b *Block) { b.Version = 1 }, ErrOldBlockVersion},
+		{"wrong height", false, func(b *Block) { b.Height++ }, ErrBadHeight},
+		{"unknown parent", false, func(b *Block) { b.PrevHash = make([]byte, 32) }, ErrUnknownParent},
+		{"bad merkle root", false, func(b *Block) { b.MerkleRoot = make([]byte, 32) }, ErrBadMerkleRoot},
+		{"not after the median time past", false, func(b *Block) { b.Timestamp = genesis.Timestamp }, ErrBadTimestamp},
+		{"in the future", false, func(b *Block) {
+			b.Timestamp = time.Now().Add(MaxFutureBlockTime).Unix() + 60
+		}, ErrBadTimestamp},
+		{"forged coinbase ID", false, func(b *Block) {
+			b.Transactions[0].ID = genesis.Transactions[0].ID
+			remerkle(b)
+		}, ErrBadTxID},
+		{"forged transaction ID", true, func(b *Block) {
+			b.Transactions[1].ID = genesis.Transactions[0].ID
+			remerkle(b)
+		}, ErrBadTxID},
+		{"coinbase without inputs", false, func(b *Block) {
+			b.Transactions[0].Inputs = nil
+			b.Transactions[0].SetID()
+			remerkle(b)
+		}, ErrEmptyTransaction},
+		{"transaction without outputs", true, func(b *Block) {
+			b.Transactions[1].Outputs = nil
+			b.Transactions[1].SetID()
+			remerkle(b)
+		}, ErrEmptyTransaction},
+		{"negative output", false, func(b *Block) {
+			b.Transactions[0].Outputs[0].Value = -1
+			b.Transactions[0].SetID()
+			remerkle(b)
+		}, ErrBadOutputValue},
+		{"output of MaxInt", false, func(b *Block) {
+			b.Transactions[0].Outputs[0].Value = int(^uint(0) >> 1)
+			b.Transactions[0].SetID()
+			remerkle(b)
+		}, ErrBadOutputValue},
+		{"outputs adding up past the money supply", false, func(b *Block) {
+			coinbase := b.Transactions[0]
+			coinbase.Outputs[0].Value = MaxMoney()
+			coinbase.Outputs = append(coinbase.Outputs, coinbase.Outputs[0])
+			coinbase.SetID()
+			remerkle(b)
+		}, ErrValueOverflow},
+		{"second coinbase", false, func(b *Block) {
+			b.Transactions = append(b.Transactions, b.Transactions[0])
+			remerkle(b)
+		}, ErrBadCoinbase},
+		{"double spend", true, func(b *Block) {
+			b.Transactions = append(b.Transactions, b.Transactions[1])
+			remerkle(b)
+		}, ErrDoubleSpend},
+		{"missing input", true, func(b *Block) {
+			b.Transactions[1].Inputs[0].Out = 5
+			b.Transactions[1].SetID()
+			remerkle(b)
+		}, ErrMissingInput},
+		{"bad signature", true, func(b *Block) {
+			b.Transactions[1].Inputs[0].Signature[0] ^= 1 //The ID doesn't cover signatures
+		}, ErrBadSignature},
+		{"coinbase pays too much", false, func(b *Block) {
+			b.Transactions[0].Outputs[0].Value++
+			b.Transactions[0].SetID()
+			remerkle(b)
+		}, ErrBadCoinbaseValue},
+	}
+
+	for _, test := range tests {
+		var txs []*Transaction
+		if test.spend {
+			txs = append(txs, send(t, chain, owner, other, 10))
+		}
+		block := newTestBlock(t, chain, parent, owner, test.change, txs...)
+
+		err := chain.ValidateBlock(block)
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+			continue
+		}
+		var blockErr *BlockError
+		if test.want != nil && !errors.As(err, &blockErr) {
+			t.Errorf("%s: %v is not a *BlockError", test.name, err)
+		}
+	}
+}
+
+//Errors other than a transaction's, like the UTXO set failing to decode, used to be asserted to *TxError and panic
+func TestBlockTxError(t *testing.T) {
+	block := &Block{Hash: []byte{0x0c}}
+	tx := &Transaction{ID: []byte{0xaa}}
+
+	corrupt := fmt.Errorf("%w: utxo", ErrCorrupt)
+	if err := blockTxError(block, corrupt); err != corrupt {
+		t.Errorf("got %v, want %v", err, corrupt)
+	}
+
+	err := blockTxError(block, txError(tx, ErrBadSignature, ""))
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v, want a *BlockError for %v", err, ErrBadSignature)
+	}
+}
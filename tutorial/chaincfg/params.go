@@ -0,0 +1,128 @@
+package chaincfg
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownNetwork = errors.New("unknown network")
+)
+
+//ChainParams are the rules a network's nodes have to agree on. Nodes with different parameters can't share a chain
+type ChainParams struct {
+	Name string
+
+	//Genesis block, built from these on every node so they all start from the same block
+	GenesisTimestamp  int64
+	GenesisPubKeyHash []byte //Owner of the genesis coinbase's output. Nobody has a key for the built-in networks' one
+	GenesisData       string //Data of the genesis coinbase
+	GenesisBits       int    //Difficulty of the genesis block, and of every block until the first retarget
+
+	//Subsidy schedule
+	Reward          int //The subsidy for mining a block, before any halving
+	HalvingInterval int //Number of blocks between each halving of the subsidy
+
+	//Difficulty rules
+	MinDifficulty    int
+	MaxDifficulty    int
+	RetargetInterval int  //Number of blocks between difficulty adjustments
+	TargetBlockTime  int  //Seconds we aim to spend mining each block
+	MaxRetargetStep  int  //Most bits the difficulty can move by in a single adjustment
+	NoRetargeting    bool //Keeps every block at GenesisBits
+
+	Consensus string //Engine that seals the blocks after the genesis block, pow, pos or poa
+
+	//Public key hashes of the authorities a proof of authority chain starts with. Without any, it starts with the
+	//owner of the genesis coinbase's output
+	Authorities [][]byte
+
+	AddressVersion byte //First byte of every address, so addresses of one network aren't valid on another
+
+	//Network
+	Magic       [4]byte //Starts every message, so nodes of different networks ignore each other
+	DefaultPort int     //Port of the first known node, which every other node introduces itself to
+}
+
+var (
+	MainNet = ChainParams{
+		Name:              "mainnet",
+		GenesisTimestamp:  1609459200,
+		GenesisPubKeyHash: make([]byte, 20),
+		GenesisData:       "First Transaction from Genesis",
+		GenesisBits:       12,
+		Consensus:         "pow",
+		Reward:            100,
+		HalvingInterval:   210,
+		MinDifficulty:     1,
+		MaxDifficulty:     240,
+		RetargetInterval:  10,
+		TargetBlockTime:   10,
+		MaxRetargetStep:   2,
+		AddressVersion:    0x00,
+		Magic:             [4]byte{0xf9, 0xbe, 0xb4, 0xd9},
+		DefaultPort:       3000,
+	}
+
+	//TestNet is for trying things out with coins that are worth nothing, mined at a lower difficulty
+	TestNet = ChainParams{
+		Name:              "testnet",
+		GenesisTimestamp:  1609459200,
+		GenesisPubKeyHash: make([]byte, 20),
+		GenesisData:       "First Transaction from the Testnet Genesis",
+		GenesisBits:       8,
+		Consensus:         "pow",
+		Reward:            100,
+		HalvingInterval:   210,
+		MinDifficulty:     1,
+		MaxDifficulty:     240,
+		RetargetInterval:  10,
+		TargetBlockTime:   10,
+		MaxRetargetStep:   2,
+		AddressVersion:    0x6f,
+		Magic:             [4]byte{0x0b, 0x11, 0x09, 0x07},
+		DefaultPort:       13000,
+	}
+
+	//RegTest is for tests. Its blocks need no work, so they are mined as soon as they are asked for
+	RegTest = ChainParams{
+		Name:              "regtest",
+		GenesisTimestamp:  1609459200,
+		GenesisPubKeyHash: make([]byte, 20),
+		GenesisData:       "First Transaction from the Regtest Genesis",
+		GenesisBits:       0,
+		Consensus:         "pow",
+		Reward:            100,
+		HalvingInterval:   150,
+		MinDifficulty:     0,
+		MaxDifficulty:     240,
+		RetargetInterval:  10,
+		TargetBlockTime:   10,
+		MaxRetargetStep:   2,
+		NoRetargeting:     true,
+		AddressVersion:    0x6f,
+		Magic:             [4]byte{0xfa, 0xbf, 0xb5, 0xda},
+		DefaultPort:       23000,
+	}
+
+	//Active are the parameters of the network the process runs on, mainnet unless Select picks another
+	Active = &MainNet
+
+	networks = []*ChainParams{&MainNet, &TestNet, &RegTest}
+)
+
+//Select makes the named network's parameters the Active ones. It returns ErrUnknownNetwork for a name with no profile
+func Select(name string) error {
+	for _, params := range networks {
+		if params.Name == name {
+			Active = params
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q, use mainnet, testnet or regtest", ErrUnknownNetwork, name)
+}
+
+//SeedNode is the address of the first known node
+func (p *ChainParams) SeedNode() string {
+	return fmt.Sprintf("localhost:%d", p.DefaultPort)
+}
@@ -2,30 +2,50 @@ package cli
 
 import (
 	"GolangBlockchain/tutorial/blockchain"
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/config"
+	"GolangBlockchain/tutorial/network"
 	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
+	"time"
 )
 
 const (
 	ERROR_INVALID_ADDRESS = "Address is not valid"
 )
 
-type CommandLine struct{}
+type CommandLine struct {
+	conf config.Config
+}
 
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("print :: prints the blocks in the blockchain")
+	fmt.Println("printchain -format FORMAT :: prints the blocks in the blockchain, as text (the default) or as a JSON array")
+	fmt.Println("getblock -hash HASH -height HEIGHT :: prints the block with the hash, or the best chain's block at the height")
 	fmt.Println("getbalance -address ADDRESS :: get the balance for the address")
-	fmt.Println("createblockchain -address ADDRESS :: creates a blockchain for the address")
-	fmt.Println("send -from FROM -to TO -amount AMOUNT :: send amount from address to another address")
+	fmt.Println("createblockchain -address ADDRESS -consensus ENGINE :: creates a blockchain from the network's genesis block and seals a first block paying the address, sealing blocks with pow, pos or poa, the network's engine by default")
+	fmt.Println("send -from FROM -to TO -amount AMOUNT -fee FEE -feerate RATE -estimate -mine -miner ADDRESS :: send amount from address to another address, paying FEE plus RATE per 1000 bytes to the miner. -estimate shows the fee without sending. When the -mine flag is set, mine off of this node and pay the reward to -miner, or FROM if it isn't given")
 	fmt.Println("createwallet :: Creates a new wallet")
 	fmt.Println("listaddresses :: Lists the addresses in our wallet file")
 	fmt.Println("reindexutxo :: Rebuilds the UTXO set")
+	fmt.Println("reindextxs :: Rebuilds the transaction index")
+	fmt.Println("merkleproof -txid TXID :: Prints and verifies the merkle inclusion proof for a transaction")
+	fmt.Println("rewind -height HEIGHT :: Disconnects blocks from the tip until the chain is at HEIGHT")
+	fmt.Println("invalidateblock -hash HASH :: Marks a block invalid and rewinds the chain to before it")
+	fmt.Println("authorities :: Lists the authorities that can sign the next block of a poa chain, and this node's proposals")
+	fmt.Println("propose -address ADDRESS -remove :: Votes to add the address as a poa authority, or to remove it, in every block this node signs")
+	fmt.Println("startnode -miner ADDRESS :: Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println()
+	fmt.Println("Every command also takes -datadir DIR -network NETWORK -config FILE :: the network to use, mainnet, testnet or regtest, and where the node keeps its chain and wallets, DIR/NETWORK/NODE_ID. They default to $BLOCKCHAIN_DATADIR, $BLOCKCHAIN_NETWORK and $BLOCKCHAIN_CONFIG, then the config file, then ~/.golangblockchain and mainnet. The config file's genesis, consensus and authorities set the address the genesis block pays, the engine and the addresses a poa chain starts with, for a private network")
 }
 
 func (cli *CommandLine) validateArgs() {
@@ -35,8 +55,39 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+//continueChain opens the node's chain, stopping the command with a message if the node doesn't have one yet
+func (cli *CommandLine) continueChain(nodeID string) *blockchain.BlockChain {
+	chain, err := blockchain.ContinueBlockChain(cli.conf.BlocksDir(nodeID))
+	if errors.Is(err, blockchain.ErrNoChain) {
+		fmt.Println("No existing blockchain found. Need to create one")
+		runtime.Goexit()
+	} else if err != nil {
+		log.Panic(err)
+	}
+
+	return chain
+}
+
+func (cli *CommandLine) startNode(nodeID, minerAddress string) {
+	fmt.Printf("Starting Node %s\n", nodeID)
+
+	if len(minerAddress) > 0 {
+		if wallet.ValidateAddress(minerAddress) {
+			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
+		} else {
+			log.Panic("Wrong miner address!")
+		}
+	}
+	if err := network.StartServer(nodeID, minerAddress, cli.conf); err != nil {
+		log.Panic(err)
+	}
+}
+
+func (cli *CommandLine) listAddresses(nodeID string) {
+	wallets, err := wallet.CreateWallets(cli.conf.WalletFile(nodeID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
@@ -44,62 +95,170 @@ func (cli *CommandLine) listAddresses() {
 	}
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+func (cli *CommandLine) createWallet(nodeID string) {
+	wallets, err := wallet.CreateWallets(cli.conf.WalletFile(nodeID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		log.Panic(err)
+	}
+	if err := wallets.SaveFile(cli.conf.WalletFile(nodeID)); err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Printf("New address is: %s\n", address)
 }
 
-func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockChain("")
+//printChain prints the best chain from the tip down, as text or as a JSON array of blocks
+func (cli *CommandLine) printChain(format, nodeID string) {
+	if format != "text" && format != "json" {
+		fmt.Printf("Unknown format %q, use text or json\n", format)
+		runtime.Goexit()
+	}
+
+	chain := cli.continueChain(nodeID)
 	defer chain.Database.Close()
 	iterator := chain.Iterator()
 
+	var blocks []*blockchain.Block
 	for {
-		block := iterator.Next()
+		block, err := iterator.Next()
+		if err != nil {
+			log.Panic(err)
+		}
 
-		fmt.Printf("previous hash: %x\n", block.PrevHash)
-		fmt.Printf("data in block: %x\n", block.Hash)
-		pow := blockchain.NewProof(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+		if format == "json" {
+			blocks = append(blocks, block)
+		} else {
+			printBlock(chain, block)
 		}
-		fmt.Println()
 
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(blocks, "", "  ")
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Println(string(out))
+	}
 }
 
-func (cli *CommandLine) createBlockChain(address string) {
+//getBlock prints the block with the hash, or the best chain's block at the height if there is no hash
+func (cli *CommandLine) getBlock(blockHash string, height int, nodeID string) {
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	var block blockchain.Block
+	if blockHash != "" {
+		hash, err := hex.DecodeString(blockHash)
+		if err != nil {
+			log.Panic(err)
+		}
+		block, err = chain.GetBlock(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		var err error
+		block, err = chain.GetBlockByHeight(height)
+		if errors.Is(err, blockchain.ErrBlockNotFound) {
+			bestHeight, err := chain.BestHeight()
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Printf("No block at height %d, the best height is %d\n", height, bestHeight)
+			runtime.Goexit()
+		} else if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	printBlock(chain, &block)
+}
+
+func printBlock(chain *blockchain.BlockChain, block *blockchain.Block) {
+	fmt.Printf("hash: %x\n", block.Hash)
+	fmt.Printf("version: %d\n", block.Version)
+	fmt.Printf("height: %d\n", block.Height)
+	fmt.Printf("timestamp: %s\n", time.Unix(block.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("previous hash: %x\n", block.PrevHash)
+	fmt.Printf("merkle root: %x\n", block.MerkleRoot)
+	fmt.Printf("bits: %d\n", block.Bits)
+	fmt.Printf("nonce: %d\n", block.Nonce)
+	if len(block.Signer) > 0 {
+		fmt.Printf("signer: %s\n", wallet.PubKeyHashToAddress(wallet.PublicKeyHash(block.Signer)))
+	}
+	if len(block.Vote) > 0 {
+		vote := "remove"
+		if block.VoteAdd {
+			vote = "add"
+		}
+		fmt.Printf("vote: %s %s\n", vote, wallet.PubKeyHashToAddress(block.Vote))
+	}
+	fmt.Printf("seal: %s\n", strconv.FormatBool(chain.VerifySeal(block) == nil))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+func (cli *CommandLine) createBlockChain(address, consensus, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic(ERROR_INVALID_ADDRESS)
 	}
-	chain := blockchain.InitializeBlockChain(address)
-	chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	chain, err := blockchain.InitializeBlockChain(cli.conf.BlocksDir(nodeID), consensus)
+	if errors.Is(err, blockchain.ErrChainExists) {
+		fmt.Println("Blockchain already exists")
+		runtime.Goexit()
+	} else if errors.Is(err, blockchain.ErrUnknownConsensus) {
+		fmt.Printf("Error: %s\n", err)
+		runtime.Goexit()
+	} else if err != nil {
+		log.Panic(err)
+	}
+	defer chain.Database.Close()
+
+	//The genesis block is the network's, the address gets its coins from the first block after it
+	wallets, err := wallet.CreateWallets(cli.conf.WalletFile(nodeID))
+	if err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	if signer, ok := wallets.Wallets[address]; ok {
+		chain.Signer = signer
+	}
+	coinbase, err := blockchain.CoinbaseTx(address, "", blockchain.BlockSubsidy(1))
+	if err != nil {
+		log.Panic(err)
+	}
+	if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); err != nil {
+		fmt.Printf("Error: %s, the chain only has the genesis block\n", err)
+		runtime.Goexit()
+	}
 
 	fmt.Println("finished")
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
+func (cli *CommandLine) getBalance(address, nodeID string) {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
 		log.Panic(ERROR_INVALID_ADDRESS)
 	}
-	chain := blockchain.ContinueBlockChain(address)
-	UTXOSet := blockchain.UTXOSet{chain}
+	chain := cli.continueChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
 	defer chain.Database.Close()
 
 	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactionOutputs(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUnspentTransactionOutputs(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -108,46 +267,265 @@ func (cli *CommandLine) getBalance(address string) {
 	fmt.Printf("Balance of %s: %d\n", address, balance)
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
+func (cli *CommandLine) send(from, to string, amount, fee, feeRate int, nodeID string, estimate, mineNow bool, minerAddress string) {
 	if !wallet.ValidateAddress(to) || !wallet.ValidateAddress(from) {
 		log.Panic(ERROR_INVALID_ADDRESS)
 	}
-	chain := blockchain.ContinueBlockChain(from)
-	UTXOSet := blockchain.UTXOSet{chain}
+	if minerAddress == "" {
+		minerAddress = from
+	} else if !wallet.ValidateAddress(minerAddress) {
+		log.Panic(ERROR_INVALID_ADDRESS)
+	}
+	chain := cli.continueChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
 	defer chain.Database.Close()
 
-	tx := blockchain.NewTransaction(from, to, amount, &UTXOSet)
-	block := chain.AddBlock([]*blockchain.Transaction{tx})
-	UTXOSet.Update(block)
+	wallets, err := wallet.CreateWallets(cli.conf.WalletFile(nodeID))
+	if err != nil {
+		log.Panic(err)
+	}
+	w, err := wallets.GetWallet(from)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := blockchain.NewTransaction(&w, to, amount, fee, feeRate, &UTXOSet)
+	if errors.Is(err, blockchain.ErrNotEnoughFunds) {
+		fmt.Printf("Error: %s\n", err)
+		runtime.Goexit()
+	} else if err != nil {
+		log.Panic(err)
+	}
+	txFee, err := UTXOSet.Fee(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Fee: %d for %d bytes\n", txFee, len(tx.Serialize()))
+	if estimate {
+		fmt.Printf("Total: %d, not sent\n", amount+txFee)
+		return
+	}
+
+	if mineNow {
+		if signer, ok := wallets.Wallets[minerAddress]; ok {
+			chain.Signer = signer
+		}
+		pool := blockchain.NewMempool(chain)
+		if err := pool.Add(tx); err != nil {
+			log.Panic(err)
+		}
+		if _, err := pool.MineBlock(minerAddress); err != nil {
+			log.Panic(err)
+		}
+	} else {
+		network.SendTx(network.KnownNodes[0], tx)
+		fmt.Println("send tx")
+	}
+
 	fmt.Println("Successful send")
 }
 
-func (cli *CommandLine) reindexUTXO() {
-	chain := blockchain.ContinueBlockChain("")
+func (cli *CommandLine) reindexUTXO(nodeID string) {
+	chain := cli.continueChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	UTXOSet := blockchain.UTXOSet{BlockChain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		log.Panic(err)
+	}
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
 	fmt.Printf("DONE! There are %d transactions in the UTXO set.\n", count)
 }
 
+func (cli *CommandLine) reindexTransactions(nodeID string) {
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	count, err := chain.ReindexTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("DONE! There are %d transactions in the transaction index.\n", count)
+}
+
+func (cli *CommandLine) merkleProof(txID, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	proof, block, err := chain.GetMerkleProof(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("transaction: %x\n", proof.TxID)
+	fmt.Printf("block: %x\n", block.Hash)
+	fmt.Printf("height: %d\n", block.Height)
+	fmt.Printf("merkle root: %x\n", block.MerkleRoot)
+	for i, step := range proof.Steps {
+		side := "right"
+		if step.Left {
+			side = "left"
+		}
+		fmt.Printf("step %d: %x (%s)\n", i, step.Hash, side)
+	}
+
+	//A light client only has the header, so the proof is checked against the header's merkle root
+	valid := bytes.Compare(proof.MerkleRoot, block.MerkleRoot) == 0 && proof.Verify()
+	fmt.Printf("Valid: %s\n", strconv.FormatBool(valid))
+}
+
+func (cli *CommandLine) rewind(height int, nodeID string) {
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	if err := chain.RewindTo(height); err != nil {
+		log.Panic(err)
+	}
+	bestHeight, err := chain.BestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Chain rewound to height %d, tip is %x\n", bestHeight, chain.LastHash)
+}
+
+func (cli *CommandLine) invalidateBlock(blockHash, nodeID string) {
+	hash, err := hex.DecodeString(blockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	if err := chain.InvalidateBlock(hash); err != nil {
+		log.Panic(err)
+	}
+	bestHeight, err := chain.BestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block %x invalidated, tip is %x at height %d\n", hash, chain.LastHash, bestHeight)
+}
+
+func (cli *CommandLine) authorities(nodeID string) {
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	bestHeight, err := chain.BestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+	nextHeight := bestHeight + 1
+	authorities, err := chain.Authorities(chain.LastHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	for i, pubKeyHash := range authorities {
+		turn := ""
+		if nextHeight%len(authorities) == i {
+			turn = " (in turn)"
+		}
+		fmt.Printf("%s%s\n", wallet.PubKeyHashToAddress(pubKeyHash), turn)
+	}
+
+	proposals, err := chain.Proposals()
+	if err != nil {
+		log.Panic(err)
+	}
+	for candidate, add := range proposals {
+		pubKeyHash, err := hex.DecodeString(candidate)
+		if err != nil {
+			log.Panic(err)
+		}
+		vote := "remove"
+		if add {
+			vote = "add"
+		}
+		fmt.Printf("proposing to %s %s\n", vote, wallet.PubKeyHashToAddress(pubKeyHash))
+	}
+}
+
+func (cli *CommandLine) propose(address string, remove bool, nodeID string) {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		log.Panic(ERROR_INVALID_ADDRESS)
+	}
+
+	chain := cli.continueChain(nodeID)
+	defer chain.Database.Close()
+
+	if err := chain.Propose(pubKeyHash, !remove); err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("Proposal saved, it is voted on in every block this node signs")
+}
+
 func (cli *CommandLine) Run() {
 	cli.validateArgs()
 
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		fmt.Printf("NODE_ID env is not set!")
+		runtime.Goexit()
+	}
+
+	blockchain.MiningProgress = os.Stdout
+
 	getBalaceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxsCmd := flag.NewFlagSet("reindextxs", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	merkleProofCmd := flag.NewFlagSet("merkleproof", flag.ExitOnError)
+	rewindCmd := flag.NewFlagSet("rewind", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	authoritiesCmd := flag.NewFlagSet("authorities", flag.ExitOnError)
+	proposeCmd := flag.NewFlagSet("propose", flag.ExitOnError)
 
 	getBalanceAddress := getBalaceCmd.String("address", "", "The address to get the balance from")
 	createBlockChainAddress := createBlockchainCmd.String("address", "", "The address to create the blockchain for")
+	createBlockChainConsensus := createBlockchainCmd.String("consensus", "", "The consensus engine that seals blocks, pow, pos or poa, defaults to the network's")
 	sendFrom := sendCmd.String("from", "", "source wallet address")
 	sendTo := sendCmd.String("to", "", "destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "amount to send")
+	sendFee := sendCmd.Int("fee", 0, "fee to pay the miner")
+	sendFeeRate := sendCmd.Int("feerate", 0, "fee to pay the miner for every 1000 bytes of the transaction, on top of -fee")
+	sendEstimate := sendCmd.Bool("estimate", false, "show the fee the transaction would pay without sending it")
+	sendMine := sendCmd.Bool("mine", false, "mine immediately on the same node")
+	sendMiner := sendCmd.String("miner", "", "address the mining reward goes to when -mine is set, defaults to FROM")
+	printChainFormat := printChainCmd.String("format", "text", "output format, text or json")
+	getBlockHash := getBlockCmd.String("hash", "", "hash of the block to print")
+	getBlockHeight := getBlockCmd.Int("height", -1, "height of the best chain's block to print")
+	startNodeMiner := startNodeCmd.String("miner", "", "enable mining mode and send reward to ADDRESS")
+	merkleProofTxID := merkleProofCmd.String("txid", "", "ID of the transaction to prove")
+	rewindHeight := rewindCmd.Int("height", -1, "height to rewind the chain to")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "hash of the block to invalidate")
+	proposeAddress := proposeCmd.String("address", "", "address of the authority to vote on")
+	proposeRemove := proposeCmd.Bool("remove", false, "vote to remove the authority instead of adding it")
+
+	var dataDir, networkName, configPath string
+	for _, cmd := range []*flag.FlagSet{getBalaceCmd, createBlockchainCmd, sendCmd, printChainCmd, getBlockCmd, createWalletCmd, listAddressesCmd,
+		reindexUTXOCmd, reindexTxsCmd, startNodeCmd, merkleProofCmd, rewindCmd, invalidateBlockCmd, authoritiesCmd, proposeCmd} {
+		cmd.StringVar(&dataDir, "datadir", "", "directory the chain and wallets of every network are kept in")
+		cmd.StringVar(&networkName, "network", "", "network to use, mainnet, testnet or regtest")
+		cmd.StringVar(&configPath, "config", "", "JSON config file with datadir and network settings")
+	}
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -174,21 +552,86 @@ func (cli *CommandLine) Run() {
 		if err := printChainCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "getblock":
+		if err := getBlockCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		if err := reindexUTXOCmd.Parse(os.Args[2:]); err != nil {
 			log.Panic(err)
 		}
+	case "reindextxs":
+		if err := reindexTxsCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "startnode":
+		if err := startNodeCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "merkleproof":
+		if err := merkleProofCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "rewind":
+		if err := rewindCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "invalidateblock":
+		if err := invalidateBlockCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "authorities":
+		if err := authoritiesCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+	case "propose":
+		if err := proposeCmd.Parse(os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
 	}
 
+	conf, err := config.Load(dataDir, networkName, configPath)
+	if err != nil {
+		log.Panic(err)
+	}
+	cli.conf = conf
+
+	if err := chaincfg.Select(conf.Network); err != nil {
+		fmt.Println(err)
+		runtime.Goexit()
+	}
+	if conf.Genesis != "" || conf.Consensus != "" || len(conf.Authorities) > 0 {
+		params := *chaincfg.Active
+		if conf.Consensus != "" {
+			params.Consensus = conf.Consensus
+		}
+		if conf.Genesis != "" {
+			pubKeyHash, err := wallet.AddressToPubKeyHash(conf.Genesis)
+			if err != nil {
+				log.Panic(ERROR_INVALID_ADDRESS)
+			}
+			params.GenesisPubKeyHash = pubKeyHash
+		}
+		for _, authority := range conf.Authorities {
+			pubKeyHash, err := wallet.AddressToPubKeyHash(authority)
+			if err != nil {
+				log.Panic(ERROR_INVALID_ADDRESS)
+			}
+			params.Authorities = append(params.Authorities, pubKeyHash)
+		}
+		chaincfg.Active = &params
+	}
+	network.KnownNodes = []string{chaincfg.Active.SeedNode()}
+
 	if getBalaceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalaceCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.getBalance(*getBalanceAddress)
+		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -196,7 +639,10 @@ func (cli *CommandLine) Run() {
 			createBlockchainCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.createBlockChain(*createBlockChainAddress)
+		if *createBlockChainConsensus == "" {
+			*createBlockChainConsensus = chaincfg.Active.Consensus
+		}
+		cli.createBlockChain(*createBlockChainAddress, *createBlockChainConsensus, nodeID)
 	}
 
 	if sendCmd.Parsed() {
@@ -208,26 +654,78 @@ func (cli *CommandLine) Run() {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		if *sendAmount <= 0 {
+		if *sendAmount <= 0 || *sendFee < 0 || *sendFeeRate < 0 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendFeeRate, nodeID, *sendEstimate, *sendMine, *sendMiner)
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		cli.createWallet(nodeID)
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		cli.listAddresses(nodeID)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		cli.printChain(*printChainFormat, nodeID)
+	}
+
+	if getBlockCmd.Parsed() {
+		if *getBlockHash == "" && *getBlockHeight < 0 {
+			getBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getBlock(*getBlockHash, *getBlockHeight, nodeID)
 	}
 
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO()
+		cli.reindexUTXO(nodeID)
+	}
+
+	if reindexTxsCmd.Parsed() {
+		cli.reindexTransactions(nodeID)
+	}
+
+	if startNodeCmd.Parsed() {
+		cli.startNode(nodeID, *startNodeMiner)
+	}
+
+	if merkleProofCmd.Parsed() {
+		if *merkleProofTxID == "" {
+			merkleProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.merkleProof(*merkleProofTxID, nodeID)
+	}
+
+	if rewindCmd.Parsed() {
+		if *rewindHeight < 0 {
+			rewindCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.rewind(*rewindHeight, nodeID)
+	}
+
+	if invalidateBlockCmd.Parsed() {
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.invalidateBlock(*invalidateBlockHash, nodeID)
+	}
+
+	if authoritiesCmd.Parsed() {
+		cli.authorities(nodeID)
+	}
+
+	if proposeCmd.Parsed() {
+		if *proposeAddress == "" {
+			proposeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.propose(*proposeAddress, *proposeRemove, nodeID)
 	}
 }
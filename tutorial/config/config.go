@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DefaultNetwork = "mainnet"
+
+	DataDirEnv = "BLOCKCHAIN_DATADIR"
+	NetworkEnv = "BLOCKCHAIN_NETWORK"
+	ConfigEnv  = "BLOCKCHAIN_CONFIG"
+
+	defaultDirName = ".golangblockchain"
+	configFileName = "config.json"
+	blocksDirName  = "blocks"
+	walletFileName = "wallets.data"
+)
+
+//Config says where a node keeps its chain and wallets.
+//Every network gets its own directory under DataDir, and every node ID its own directory under that, so several nodes
+//and test chains can share one machine without touching each other's files
+type Config struct {
+	DataDir string `json:"datadir"`
+	Network string `json:"network"`
+
+	//Settings a private network changes its network's parameters with
+	Genesis     string   `json:"genesis"`     //Address the genesis block pays
+	Consensus   string   `json:"consensus"`   //Engine that seals the blocks after it
+	Authorities []string `json:"authorities"` //Addresses a proof of authority chain starts with
+}
+
+//Load works out the settings that weren't given as flags, each one from the first place that has it:
+//the flag, the environment variable, the config file, then the default.
+//The config file is configPath if it is set, else $BLOCKCHAIN_CONFIG, else config.json in the default data directory
+func Load(dataDir, network, configPath string) (Config, error) {
+	config := Config{
+		DataDir: firstSet(dataDir, os.Getenv(DataDirEnv)),
+		Network: firstSet(network, os.Getenv(NetworkEnv)),
+	}
+
+	explicit := firstSet(configPath, os.Getenv(ConfigEnv))
+	path := firstSet(explicit, filepath.Join(DefaultDataDir(), configFileName))
+
+	var file Config
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(content, &file); err != nil {
+			return Config{}, fmt.Errorf("reading %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) || explicit != "" {
+		return Config{}, err
+	}
+
+	config.DataDir = firstSet(config.DataDir, file.DataDir, DefaultDataDir())
+	config.Network = firstSet(config.Network, file.Network, DefaultNetwork)
+	config.Genesis = file.Genesis
+	config.Consensus = file.Consensus
+	config.Authorities = file.Authorities
+
+	return config, nil
+}
+
+//DefaultDataDir is .golangblockchain in the user's home directory, or in the working directory if there is no home
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return defaultDirName
+	}
+	return filepath.Join(home, defaultDirName)
+}
+
+//NodeDir is the directory everything of one node on the configured network is kept in
+func (c Config) NodeDir(nodeID string) string {
+	return filepath.Join(c.DataDir, c.Network, nodeID)
+}
+
+//BlocksDir is the database directory of the node's chain
+func (c Config) BlocksDir(nodeID string) string {
+	return filepath.Join(c.NodeDir(nodeID), blocksDirName)
+}
+
+//WalletFile is the file the node's wallets are saved in
+func (c Config) WalletFile(nodeID string) string {
+	return filepath.Join(c.NodeDir(nodeID), walletFileName)
+}
+
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+//setEnv sets the environment variables Load reads for the length of the test, with HOME at home
+func setEnv(t *testing.T, home, dataDir, network, config string) {
+	t.Helper()
+	for name, value := range map[string]string{"HOME": home, DataDirEnv: dataDir, NetworkEnv: network, ConfigEnv: config} {
+		old, set := os.LookupEnv(name)
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if set {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Each setting comes from the flag, then the environment, then the config file, then the default
+func TestLoad(t *testing.T) {
+	home, err := ioutil.TempDir("", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	defaultFile := filepath.Join(home, defaultDirName, configFileName)
+	otherFile := filepath.Join(home, "other.json")
+	writeFile(t, otherFile, `{"datadir": "/other", "network": "regtest", "consensus": "poa", "authorities": ["a", "b"]}`)
+	badFile := filepath.Join(home, "bad.json")
+	writeFile(t, badFile, `{"network": `)
+
+	tests := []struct {
+		name                       string
+		defaultFile                string //Written to config.json in the default data directory, if not empty
+		flagDir, flagNet, flagConf string
+		envDir, envNet, envConf    string
+		want                       Config
+		wantErr                    bool
+	}{
+		{name: "defaults", want: Config{DataDir: filepath.Join(home, defaultDirName), Network: DefaultNetwork}},
+		{name: "default config file", defaultFile: `{"datadir": "/file", "network": "testnet", "genesis": "addr"}`,
+			want: Config{DataDir: "/file", Network: "testnet", Genesis: "addr"}},
+		{name: "environment over the file", defaultFile: `{"datadir": "/file", "network": "testnet"}`,
+			envDir: "/env", envNet: "regtest", want: Config{DataDir: "/env", Network: "regtest"}},
+		{name: "flags over the environment", envDir: "/env", envNet: "regtest", flagDir: "/flag", flagNet: "testnet",
+			want: Config{DataDir: "/flag", Network: "testnet"}},
+		{name: "config file from the environment", envConf: otherFile,
+			want: Config{DataDir: "/other", Network: "regtest", Consensus: "poa", Authorities: []string{"a", "b"}}},
+		{name: "config file flag over the environment", envConf: badFile, flagConf: otherFile,
+			want: Config{DataDir: "/other", Network: "regtest", Consensus: "poa", Authorities: []string{"a", "b"}}},
+		{name: "missing config file given", flagConf: filepath.Join(home, "missing.json"), wantErr: true},
+		{name: "missing config file from the environment", envConf: filepath.Join(home, "missing.json"), wantErr: true},
+		{name: "config file that doesn't decode", flagConf: badFile, wantErr: true},
+	}
+
+	for _, test := range tests {
+		os.Remove(defaultFile)
+		if test.defaultFile != "" {
+			writeFile(t, defaultFile, test.defaultFile)
+		}
+		setEnv(t, home, test.envDir, test.envNet, test.envConf)
+
+		got, err := Load(test.flagDir, test.flagNet, test.flagConf)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want one %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+//Every network and node gets its own directory for its chain and wallets
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		config Config
+		nodeID string
+		blocks string
+		wallet string
+	}{
+		{Config{DataDir: "/data", Network: "mainnet"}, "3000", "/data/mainnet/3000/blocks", "/data/mainnet/3000/wallets.data"},
+		{Config{DataDir: "/data", Network: "mainnet"}, "3001", "/data/mainnet/3001/blocks", "/data/mainnet/3001/wallets.data"},
+		{Config{DataDir: "/data", Network: "testnet"}, "3000", "/data/testnet/3000/blocks", "/data/testnet/3000/wallets.data"},
+	}
+
+	for _, test := range tests {
+		if got := test.config.BlocksDir(test.nodeID); got != filepath.FromSlash(test.blocks) {
+			t.Errorf("%s node %s: blocks in %s, want %s", test.config.Network, test.nodeID, got, test.blocks)
+		}
+		if got := test.config.WalletFile(test.nodeID); got != filepath.FromSlash(test.wallet) {
+			t.Errorf("%s node %s: wallets in %s, want %s", test.config.Network, test.nodeID, got, test.wallet)
+		}
+	}
+}
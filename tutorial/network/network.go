@@ -0,0 +1,711 @@
+package network
+
+import (
+	"GolangBlockchain/tutorial/blockchain"
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/config"
+	"GolangBlockchain/tutorial/wallet"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	protocol      = "tcp"
+	version       = 2 //Version 2 messages are in the binary encoding instead of gob
+	commandLength = 12
+
+	//maxMessageSize is the most read from a peer for one message, a block of the largest size with room for the
+	//magic, the command and the rest of the payload
+	maxMessageSize = blockchain.MaxBlockSize + 1024
+
+	//batchWindow is how long the miner waits after a transaction arrives before mining, so that a burst of
+	//transactions goes into one block instead of one block each
+	batchWindow = 2 * time.Second
+)
+
+var (
+	nodeAddress     string
+	mineAddress     string
+	KnownNodes      = []string{chaincfg.Active.SeedNode()}
+	blocksInTransit = [][]byte{}
+	memoryPool      *blockchain.Mempool
+	newTransactions = make(chan struct{}, 1)
+	cancelMining    context.CancelFunc //Stops the block being mined, set while the miner is working
+
+	//mutex serializes the handling of incoming messages, which all share the chain and the state above
+	mutex sync.Mutex
+)
+
+type Addr struct {
+	AddrList []string
+}
+
+type Block struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type GetBlocks struct {
+	AddrFrom string
+}
+
+type GetData struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type Inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+type Tx struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+type Version struct {
+	Version    int
+	BestHeight int
+	BestWork   []byte //Total work of the best chain, as a big endian number
+	AddrFrom   string
+}
+
+//Payload is the part of a message after the command. Payloads are written in the binary encoding blocks and
+//transactions are, starting with its version byte and followed by their fields in the order they are declared in
+type Payload interface {
+	encode(e *blockchain.Encoder)
+	decode(d *blockchain.Decoder)
+}
+
+func (p *Addr) encode(e *blockchain.Encoder) {
+	e.PutUvarint(uint64(len(p.AddrList)))
+	for _, address := range p.AddrList {
+		e.PutBytes([]byte(address))
+	}
+}
+
+func (p *Addr) decode(d *blockchain.Decoder) {
+	for i, addresses := 0, d.Count(); i < addresses; i++ {
+		p.AddrList = append(p.AddrList, string(d.Bytes()))
+	}
+}
+
+func (p *Block) encode(e *blockchain.Encoder) {
+	e.PutBytes([]byte(p.AddrFrom))
+	e.PutBytes(p.Block)
+}
+
+func (p *Block) decode(d *blockchain.Decoder) {
+	p.AddrFrom = string(d.Bytes())
+	p.Block = d.Bytes()
+}
+
+func (p *GetBlocks) encode(e *blockchain.Encoder) {
+	e.PutBytes([]byte(p.AddrFrom))
+}
+
+func (p *GetBlocks) decode(d *blockchain.Decoder) {
+	p.AddrFrom = string(d.Bytes())
+}
+
+func (p *GetData) encode(e *blockchain.Encoder) {
+	e.PutBytes([]byte(p.AddrFrom))
+	e.PutBytes([]byte(p.Type))
+	e.PutBytes(p.ID)
+}
+
+func (p *GetData) decode(d *blockchain.Decoder) {
+	p.AddrFrom = string(d.Bytes())
+	p.Type = string(d.Bytes())
+	p.ID = d.Bytes()
+}
+
+func (p *Inv) encode(e *blockchain.Encoder) {
+	e.PutBytes([]byte(p.AddrFrom))
+	e.PutBytes([]byte(p.Type))
+	e.PutUvarint(uint64(len(p.Items)))
+	for _, item := range p.Items {
+		e.PutBytes(item)
+	}
+}
+
+func (p *Inv) decode(d *blockchain.Decoder) {
+	p.AddrFrom = string(d.Bytes())
+	p.Type = string(d.Bytes())
+	for i, items := 0, d.Count(); i < items; i++ {
+		p.Items = append(p.Items, d.Bytes())
+	}
+}
+
+func (p *Tx) encode(e *blockchain.Encoder) {
+	e.PutBytes([]byte(p.AddrFrom))
+	e.PutBytes(p.Transaction)
+}
+
+func (p *Tx) decode(d *blockchain.Decoder) {
+	p.AddrFrom = string(d.Bytes())
+	p.Transaction = d.Bytes()
+}
+
+func (p *Version) encode(e *blockchain.Encoder) {
+	e.PutInt(p.Version)
+	e.PutInt(p.BestHeight)
+	e.PutBytes(p.BestWork)
+	e.PutBytes([]byte(p.AddrFrom))
+}
+
+func (p *Version) decode(d *blockchain.Decoder) {
+	p.Version = d.Int()
+	p.BestHeight = d.Int()
+	p.BestWork = d.Bytes()
+	p.AddrFrom = string(d.Bytes())
+}
+
+//CmdToBytes pads a command name out to the fixed length header every message starts with
+func CmdToBytes(cmd string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range cmd {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+func BytesToCmd(bytes []byte) string {
+	var cmd []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			cmd = append(cmd, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", cmd)
+}
+
+func ExtractCmd(request []byte) []byte {
+	return request[:commandLength]
+}
+
+func RequestBlocks() {
+	for _, node := range KnownNodes {
+		SendGetBlocks(node)
+	}
+}
+
+func SendAddr(address string) {
+	nodes := Addr{KnownNodes}
+	nodes.AddrList = append(nodes.AddrList, nodeAddress)
+	payload := EncodePayload(&nodes)
+	request := append(CmdToBytes("addr"), payload...)
+
+	SendData(address, request)
+}
+
+func SendBlock(address string, b *blockchain.Block) {
+	data := Block{nodeAddress, b.Serialize()}
+	payload := EncodePayload(&data)
+	request := append(CmdToBytes("block"), payload...)
+
+	SendData(address, request)
+}
+
+func SendInv(address, kind string, items [][]byte) {
+	inventory := Inv{nodeAddress, kind, items}
+	payload := EncodePayload(&inventory)
+	request := append(CmdToBytes("inv"), payload...)
+
+	SendData(address, request)
+}
+
+func SendTx(address string, tnx *blockchain.Transaction) {
+	data := Tx{nodeAddress, tnx.Serialize()}
+	payload := EncodePayload(&data)
+	request := append(CmdToBytes("tx"), payload...)
+
+	SendData(address, request)
+}
+
+func SendVersion(address string, chain *blockchain.BlockChain) {
+	bestHeight, err := chain.BestHeight()
+	if err != nil {
+		fmt.Printf("Can't read the best height: %s\n", err)
+		return
+	}
+	bestWork, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
+		fmt.Printf("Can't read the best chain's work: %s\n", err)
+		return
+	}
+	payload := EncodePayload(&Version{version, bestHeight, bestWork.Bytes(), nodeAddress})
+
+	request := append(CmdToBytes("version"), payload...)
+
+	SendData(address, request)
+}
+
+func SendGetBlocks(address string) {
+	payload := EncodePayload(&GetBlocks{nodeAddress})
+	request := append(CmdToBytes("getblocks"), payload...)
+
+	SendData(address, request)
+}
+
+func SendGetData(address, kind string, id []byte) {
+	payload := EncodePayload(&GetData{nodeAddress, kind, id})
+	request := append(CmdToBytes("getdata"), payload...)
+
+	SendData(address, request)
+}
+
+//SendData dials a node and writes a single request to it. Nodes that can't be reached are dropped from KnownNodes
+func SendData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+		var updatedNodes []string
+
+		for _, node := range KnownNodes {
+			if node != addr {
+				updatedNodes = append(updatedNodes, node)
+			}
+		}
+
+		KnownNodes = updatedNodes
+
+		return
+	}
+
+	defer conn.Close()
+
+	magic := chaincfg.Active.Magic
+	message := append(append([]byte{}, magic[:]...), data...)
+	if _, err = io.Copy(conn, bytes.NewReader(message)); err != nil {
+		fmt.Printf("Sending to %s failed: %s\n", addr, err)
+	}
+}
+
+func HandleAddr(request []byte) {
+	var payload Addr
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	for _, address := range payload.AddrList {
+		if address != nodeAddress && !NodeIsKnown(address) {
+			KnownNodes = append(KnownNodes, address)
+		}
+	}
+	fmt.Printf("there are %d known nodes\n", len(KnownNodes))
+	RequestBlocks()
+}
+
+func HandleBlock(request []byte, chain *blockchain.BlockChain) {
+	var payload Block
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	block, err := blockchain.Deserialize(payload.Block)
+	if err != nil {
+		fmt.Printf("Block rejected: %s\n", err)
+		blocksInTransit = [][]byte{}
+		return
+	}
+
+	fmt.Printf("Received a new block %x\n", block.Hash)
+	oldTip := chain.LastHash
+	if err := chain.AddBlock(block); err != nil {
+		fmt.Printf("Block rejected: %s\n", err)
+		blocksInTransit = [][]byte{}
+		return
+	}
+
+	if bytes.Compare(block.PrevHash, oldTip) == 0 {
+		memoryPool.RemoveBlock(block)
+	} else if bytes.Compare(chain.LastHash, oldTip) != 0 {
+		//The blocks that left the best chain take their transactions back to the mempool
+		if err := memoryPool.Reorganize(oldTip); err != nil {
+			fmt.Printf("Revalidating the mempool instead of taking back the old branch's transactions: %s\n", err)
+			memoryPool.Revalidate()
+		}
+	}
+	if bytes.Compare(chain.LastHash, oldTip) != 0 && cancelMining != nil {
+		cancelMining() //The block being mined no longer builds on the tip
+	}
+
+	if len(blocksInTransit) > 0 {
+		blockHash := blocksInTransit[0]
+		SendGetData(payload.AddrFrom, "block", blockHash)
+
+		blocksInTransit = blocksInTransit[1:]
+	}
+}
+
+func HandleInv(request []byte, chain *blockchain.BlockChain) {
+	var payload Inv
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
+
+	if payload.Type == "block" {
+		//Items arrive newest first, so they are requested oldest first to always extend the chain we have
+		blocksInTransit = [][]byte{}
+		for i := len(payload.Items) - 1; i >= 0; i-- {
+			if _, err := chain.GetBlock(payload.Items[i]); err != nil {
+				blocksInTransit = append(blocksInTransit, payload.Items[i])
+			}
+		}
+
+		if len(blocksInTransit) == 0 {
+			return
+		}
+
+		blockHash := blocksInTransit[0]
+		SendGetData(payload.AddrFrom, "block", blockHash)
+
+		blocksInTransit = blocksInTransit[1:]
+	}
+
+	if payload.Type == "tx" && len(payload.Items) > 0 {
+		txID := payload.Items[0]
+
+		if !memoryPool.Has(txID) {
+			SendGetData(payload.AddrFrom, "tx", txID)
+		}
+	}
+}
+
+func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
+	var payload GetBlocks
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	blocks, err := chain.GetBlockHashes()
+	if err != nil {
+		fmt.Printf("Can't list blocks: %s\n", err)
+		return
+	}
+	SendInv(payload.AddrFrom, "block", blocks)
+}
+
+func HandleGetData(request []byte, chain *blockchain.BlockChain) {
+	var payload GetData
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	if payload.Type == "block" {
+		block, err := chain.GetBlock([]byte(payload.ID))
+		if err != nil {
+			return
+		}
+
+		SendBlock(payload.AddrFrom, &block)
+	}
+
+	if payload.Type == "tx" {
+		tx, ok := memoryPool.Get(payload.ID)
+		if !ok {
+			return
+		}
+
+		SendTx(payload.AddrFrom, tx)
+	}
+}
+
+func HandleTx(request []byte, chain *blockchain.BlockChain) {
+	var payload Tx
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	tx, err := blockchain.DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		fmt.Printf("Transaction rejected: %s\n", err)
+		return
+	}
+	if memoryPool.Has(tx.ID) {
+		return
+	}
+	if err := memoryPool.Add(&tx); err != nil {
+		fmt.Printf("Transaction rejected: %s\n", err)
+		return
+	}
+
+	fmt.Printf("%s, %d\n", nodeAddress, memoryPool.Count())
+
+	//Relay the transaction to everyone except the node that sent it to us
+	for _, node := range KnownNodes {
+		if node != nodeAddress && node != payload.AddrFrom {
+			SendInv(node, "tx", [][]byte{tx.ID})
+		}
+	}
+
+	if len(mineAddress) > 0 {
+		signalMiner()
+	}
+}
+
+func signalMiner() {
+	select {
+	case newTransactions <- struct{}{}:
+	default: //The miner has already been told
+	}
+}
+
+//Miner mines a block out of the memory pool every time new transactions arrive, waiting batchWindow first so
+//that it packs as many of them as it can
+func Miner(chain *blockchain.BlockChain) {
+	for range newTransactions {
+		time.Sleep(batchWindow)
+		MineTx(chain)
+	}
+}
+
+//MineTx mines the best transactions in the memory pool into a new block with a coinbase for the miner, and announces the block.
+//The proof of work runs without holding the mutex, so a block arriving from a peer in the meantime can cancel it
+func MineTx(chain *blockchain.BlockChain) {
+	mutex.Lock()
+	newBlock, err := memoryPool.BlockTemplate(mineAddress)
+	if err != nil {
+		fmt.Printf("Can't build a block: %s\n", err)
+	}
+	if newBlock == nil {
+		mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelMining = cancel
+	mutex.Unlock()
+
+	err = chain.Engine.Seal(ctx, chain, newBlock)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	cancelMining = nil
+	cancel()
+
+	if err != nil {
+		fmt.Printf("Mining stopped: %s\n", err)
+		signalMiner() //Try again on top of the new tip with whatever is still pending
+		return
+	}
+
+	if err := chain.AddBlock(newBlock); err != nil {
+		fmt.Printf("Mined block rejected: %s\n", err)
+		return
+	}
+	if bytes.Compare(chain.LastHash, newBlock.Hash) != 0 {
+		return //A peer's block got there first
+	}
+	memoryPool.RemoveBlock(newBlock)
+
+	fmt.Printf("New Block mined with %d transactions, %d left in the mempool\n", len(newBlock.Transactions)-1, memoryPool.Count())
+
+	for _, node := range KnownNodes {
+		if node != nodeAddress {
+			SendInv(node, "block", [][]byte{newBlock.Hash})
+		}
+	}
+
+	//Whatever didn't fit goes into the next block
+	if memoryPool.Count() > 0 {
+		signalMiner()
+	}
+}
+
+func HandleVersion(request []byte, chain *blockchain.BlockChain) {
+	var payload Version
+
+	if err := decodePayload(request, &payload); err != nil {
+		fmt.Printf("Ignoring message: %s\n", err)
+		return
+	}
+
+	if payload.Version != version {
+		fmt.Printf("Ignoring %s, it speaks protocol version %d\n", payload.AddrFrom, payload.Version)
+		return
+	}
+
+	//The chain with the most work wins, which isn't always the longest
+	bestWork, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
+		fmt.Printf("Can't read the best chain's work: %s\n", err)
+		return
+	}
+	otherWork := new(big.Int).SetBytes(payload.BestWork)
+
+	if cmp := bestWork.Cmp(otherWork); cmp < 0 {
+		SendGetBlocks(payload.AddrFrom)
+	} else if cmp > 0 {
+		SendVersion(payload.AddrFrom, chain)
+	}
+
+	if !NodeIsKnown(payload.AddrFrom) {
+		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	}
+}
+
+func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
+	req, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	defer conn.Close()
+
+	if err != nil {
+		fmt.Printf("Reading from %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	if len(req) > maxMessageSize {
+		fmt.Printf("Ignoring message from %s, it is larger than %d bytes\n", conn.RemoteAddr(), maxMessageSize)
+		return
+	}
+
+	magic := chaincfg.Active.Magic
+	if len(req) < len(magic)+commandLength {
+		return
+	}
+	if !bytes.Equal(req[:len(magic)], magic[:]) {
+		fmt.Printf("Ignoring message from %s, it is for another network\n", conn.RemoteAddr())
+		return
+	}
+	req = req[len(magic):]
+
+	command := BytesToCmd(req[:commandLength])
+	fmt.Printf("Received %s command\n", command)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch command {
+	case "addr":
+		HandleAddr(req)
+	case "block":
+		HandleBlock(req, chain)
+	case "inv":
+		HandleInv(req, chain)
+	case "getblocks":
+		HandleGetBlocks(req, chain)
+	case "getdata":
+		HandleGetData(req, chain)
+	case "tx":
+		HandleTx(req, chain)
+	case "version":
+		HandleVersion(req, chain)
+	default:
+		fmt.Println("Unknown command")
+	}
+}
+
+//StartServer listens on localhost:nodeID and answers peers until the process is interrupted, with the chain and
+//wallets kept for nodeID in conf's data directory.
+//Every node other than the first known node introduces itself to it on startup
+func StartServer(nodeID, minerAddress string, conf config.Config) error {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	mineAddress = minerAddress
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	//A node without a chain starts from the network's genesis block, and gets the rest from its peers
+	chain, err := blockchain.ContinueBlockChain(conf.BlocksDir(nodeID))
+	if errors.Is(err, blockchain.ErrNoChain) {
+		fmt.Println("No existing blockchain found, starting from the genesis block")
+		chain, err = blockchain.InitializeBlockChain(conf.BlocksDir(nodeID), chaincfg.Active.Consensus)
+	}
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	go CloseDB(chain)
+
+	if wallets, err := wallet.CreateWallets(conf.WalletFile(nodeID)); err == nil {
+		if signer, ok := wallets.Wallets[mineAddress]; ok {
+			chain.Signer = signer //Engines that sign blocks sign them with the miner's key
+		}
+	}
+	memoryPool = blockchain.NewMempool(chain)
+	if len(mineAddress) > 0 {
+		go Miner(chain)
+	}
+
+	if nodeAddress != KnownNodes[0] {
+		SendVersion(KnownNodes[0], chain)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go HandleConnection(conn, chain)
+	}
+}
+
+//EncodePayload writes a message's payload
+func EncodePayload(payload Payload) []byte {
+	var e blockchain.Encoder
+	e.PutVersion()
+	payload.encode(&e)
+	return e.Bytes()
+}
+
+//decodePayload decodes the part of a request after the command. Peers can send anything, so it fails instead of panicking
+func decodePayload(request []byte, payload Payload) error {
+	d := blockchain.NewDecoder(request[commandLength:])
+	d.Version()
+	payload.decode(d)
+	return d.Finish("payload")
+}
+
+func NodeIsKnown(addr string) bool {
+	for _, node := range KnownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+//CloseDB waits for an interrupt and closes the database cleanly so the next start doesn't find it locked
+func CloseDB(chain *blockchain.BlockChain) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	<-interrupt
+	mutex.Lock()
+	chain.Database.Close()
+	os.Exit(1)
+}
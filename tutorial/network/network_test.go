@@ -0,0 +1,206 @@
+package network
+
+import (
+	"GolangBlockchain/tutorial/blockchain"
+	"GolangBlockchain/tutorial/chaincfg"
+	"GolangBlockchain/tutorial/config"
+	"GolangBlockchain/tutorial/wallet"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPayloadGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload Payload
+		want    string
+		decoded Payload
+	}{
+		{"addr", &Addr{[]string{"a", "bc"}}, "01" + "02" + "0161" + "026263", &Addr{}},
+		{"block", &Block{"a", []byte{0x0c}}, "01" + "0161" + "010c", &Block{}},
+		{"getblocks", &GetBlocks{"a"}, "01" + "0161", &GetBlocks{}},
+		{"getdata", &GetData{"a", "tx", []byte{0xaa}}, "01" + "0161" + "027478" + "01aa", &GetData{}},
+		{"inv", &Inv{"a", "block", [][]byte{{0x0c}, {0x0d}}}, "01" + "0161" + "05626c6f636b" + "02" + "010c" + "010d", &Inv{}},
+		{"tx", &Tx{"a", []byte{0xaa}}, "01" + "0161" + "01aa", &Tx{}},
+		{"version", &Version{2, 7, []byte{0x01, 0x00}, "a"}, "01" + "04" + "0e" + "020100" + "0161", &Version{}}, //Version 2, BestHeight 7, BestWork 256, AddrFrom
+	}
+
+	for _, test := range tests {
+		encoded := EncodePayload(test.payload)
+		if got := hex.EncodeToString(encoded); got != test.want {
+			t.Errorf("%s encodes to %s, want %s", test.name, got, test.want)
+		}
+
+		request := append(CmdToBytes(test.name), encoded...)
+		if err := decodePayload(request, test.decoded); err != nil {
+			t.Errorf("decoding %s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.decoded, test.payload) {
+			t.Errorf("%s decodes to %+v, want %+v", test.name, test.decoded, test.payload)
+		}
+	}
+}
+
+//An inv without items used to panic on the first one
+func TestHandleInvEmpty(t *testing.T) {
+	for _, kind := range []string{"tx", "block"} {
+		request := append(CmdToBytes("inv"), EncodePayload(&Inv{"a", kind, nil})...)
+		HandleInv(request, nil)
+	}
+}
+
+//A peer that keeps sending is cut off after maxMessageSize bytes instead of being read into memory until it stops
+func TestHandleConnectionTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		magic := chaincfg.Active.Magic
+		client.Write(append(append(magic[:], CmdToBytes("block")...), make([]byte, 2*maxMessageSize)...))
+		client.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		HandleConnection(server, nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleConnection is still reading")
+	}
+}
+
+//TestHelperNode runs a node of TestTwoNodesSync in a process of its own, as a node keeps its state in globals.
+//It does nothing unless that test runs it
+func TestHelperNode(t *testing.T) {
+	nodeID := os.Getenv("NETWORK_TEST_NODE")
+	if nodeID == "" {
+		return
+	}
+
+	chaincfg.Active = &chaincfg.RegTest
+	KnownNodes = []string{chaincfg.Active.SeedNode()}
+	conf := config.Config{DataDir: os.Getenv("NETWORK_TEST_DATADIR"), Network: chaincfg.Active.Name}
+	if err := StartServer(nodeID, "", conf); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+//startNode runs TestHelperNode in a new process, and returns it along with its output
+func startNode(t *testing.T, dataDir, nodeID string) (*exec.Cmd, io.Reader) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperNode$")
+	cmd.Env = append(os.Environ(), "NETWORK_TEST_NODE="+nodeID, "NETWORK_TEST_DATADIR="+dataDir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, stdout
+}
+
+//stopNode stops a node the way a user would, which closes its database once it is done with the message at hand
+func stopNode(cmd *exec.Cmd) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+}
+
+//A node started without a chain starts from the network's genesis block, and gets the seed node's blocks from it
+func TestTwoNodesSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two nodes")
+	}
+	chaincfg.Active = &chaincfg.RegTest
+	defer func() { chaincfg.Active = &chaincfg.MainNet }()
+
+	dir, err := ioutil.TempDir("", "nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := config.Config{DataDir: dir, Network: chaincfg.Active.Name}
+	seedID, nodeID := strconv.Itoa(chaincfg.Active.DefaultPort), strconv.Itoa(chaincfg.Active.DefaultPort+1)
+
+	miner, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := blockchain.InitializeBlockChain(conf.BlocksDir(seedID), chaincfg.Active.Consensus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height <= 3; height++ {
+		coinbase, err := blockchain.CoinbaseTx(string(miner.Address()), "", blockchain.BlockSubsidy(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := chain.LastHash
+	chain.Database.Close()
+
+	seed, _ := startNode(t, dir, seedID)
+	defer stopNode(seed)
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		conn, err := net.Dial(protocol, chaincfg.Active.SeedNode())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("seed node isn't listening: %s", err)
+		}
+	}
+
+	node, stdout := startNode(t, dir, nodeID)
+	received, finished := make(chan struct{}), make(chan struct{})
+	var output bytes.Buffer
+	go func() {
+		defer close(finished)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			output.WriteString(scanner.Text() + "\n")
+			if scanner.Text() == fmt.Sprintf("Received a new block %x", tip) {
+				close(received)
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-received:
+		stopNode(node)
+	case <-time.After(20 * time.Second):
+		stopNode(node)
+		<-finished
+		t.Fatalf("node didn't get the seed node's tip %x:\n%s", tip, output.String())
+	}
+
+	synced, err := blockchain.ContinueBlockChain(conf.BlocksDir(nodeID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer synced.Database.Close()
+	if bytes.Compare(synced.LastHash, tip) != 0 {
+		t.Errorf("node's tip is %x, want %x", synced.LastHash, tip)
+	}
+}
@@ -1,8 +1,8 @@
 package wallet
 
 import (
+	"fmt"
 	"github.com/mr-tron/base58"
-	"log"
 )
 
 func Base58Encode(input []byte) []byte {
@@ -11,11 +11,11 @@ func Base58Encode(input []byte) []byte {
 	return []byte(encode)
 }
 
-func Base58Decode(input []byte) []byte {
+func Base58Decode(input []byte) ([]byte, error) {
 	decode, err := base58.Decode(string(input[:]))
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, err)
 	}
 
-	return decode
+	return decode, nil
 }
@@ -1,20 +1,29 @@
 package wallet
 
 import (
+	"GolangBlockchain/tutorial/chaincfg"
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"errors"
 	"fmt"
-	"log"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
-	checksumLength = 4
-	version        = byte(0x00)
+	checksumLength   = 4
+	coordLength      = 32 //Bytes in each coordinate of a P256 public key
+	PubKeyHashLength = 20 //Bytes in a public key hash, a RIPEMD-160 hash
+)
+
+var (
+	ErrInvalidAddress   = errors.New("address is not valid")
+	ErrInvalidPublicKey = errors.New("public key is not valid")
 )
 
 type Wallet struct {
@@ -22,56 +31,131 @@ type Wallet struct {
 	PublicKey  []byte
 }
 
-//Address collects the checksum, version, and public key to create an address for a wallet
+type gobWallet struct {
+	D         []byte
+	PublicKey []byte
+}
+
+//Address collects the checksum, the active network's version, and public key to create an address for a wallet
 func (w Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
 
-	versionedHash := append([]byte{version}, pubHash...)
+	versionedHash := append([]byte{chaincfg.Active.AddressVersion}, pubHash...)
 	checksum := Checksum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
 	address := Base58Encode(fullHash)
 
-	fmt.Printf("pub key: %x\n", w.PublicKey)
-	fmt.Printf("pub hash: %x\n", pubHash)
-	fmt.Printf("address: %x\n", address)
-
 	return address
 }
 
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
+//PubKeyHashToAddress builds the address for a public key hash, like Address does for a wallet's public key
+func PubKeyHashToAddress(pubKeyHash []byte) string {
+	versionedHash := append([]byte{chaincfg.Active.AddressVersion}, pubKeyHash...)
+	fullHash := append(versionedHash, Checksum(versionedHash)...)
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return string(Base58Encode(fullHash))
 }
 
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+//AddressToPubKeyHash strips the version and checksum off an address, leaving its public key hash.
+//It returns ErrInvalidAddress if the address doesn't decode, its checksum is wrong or it is for another network
+func AddressToPubKeyHash(address string) ([]byte, error) {
+	fullHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+	if len(fullHash) != 1+PubKeyHashLength+checksumLength {
+		return nil, fmt.Errorf("%w: %q is not %d bytes long", ErrInvalidAddress, address, 1+PubKeyHashLength+checksumLength)
+	}
+
+	actualChecksum := fullHash[len(fullHash)-checksumLength:]
+	targetChecksum := Checksum(fullHash[:len(fullHash)-checksumLength])
+	if bytes.Compare(actualChecksum, targetChecksum) != 0 {
+		return nil, fmt.Errorf("%w: %q has a bad checksum", ErrInvalidAddress, address)
+	}
+	if fullHash[0] != chaincfg.Active.AddressVersion {
+		return nil, fmt.Errorf("%w: %q is for another network", ErrInvalidAddress, address)
+	}
+
+	return fullHash[1 : len(fullHash)-checksumLength], nil
+}
+
+func ValidateAddress(address string) bool {
+	_, err := AddressToPubKeyHash(address)
+	return err == nil
+}
+
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
+	}
+
+	//X and Y are padded, so the key always splits in half
+	pub := make([]byte, 2*coordLength)
+	private.PublicKey.X.FillBytes(pub[:coordLength])
+	private.PublicKey.Y.FillBytes(pub[coordLength:])
+	return *private, pub, nil
+}
+
+//ParsePublicKey turns the X and Y a public key is stored as back into a point on P256.
+//Keys from before NewKeyPair padded X and Y can be a byte or two short, and are split wherever lands on the curve
+func ParsePublicKey(pub []byte) (ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+
+	for xLength := coordLength; xLength >= len(pub)-coordLength && xLength > 0; xLength-- {
+		x := new(big.Int).SetBytes(pub[:xLength])
+		y := new(big.Int).SetBytes(pub[xLength:])
+		if curve.IsOnCurve(x, y) {
+			return ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+
+	return ecdsa.PublicKey{}, fmt.Errorf("%w: %x", ErrInvalidPublicKey, pub)
+}
+
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
 	}
+	return &Wallet{private, public}, nil
+}
+
+//GobEncode stores only the private scalar and public key, as the curve itself can't be gob encoded
+func (w Wallet) GobEncode() ([]byte, error) {
+	var content bytes.Buffer
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(gobWallet{w.PrivateKey.D.Bytes(), w.PublicKey})
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pub
+	return content.Bytes(), err
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
-	return &Wallet{private, public}
+//GobDecode rebuilds the full key pair on the P256 curve from the stored private scalar
+func (w *Wallet) GobDecode(data []byte) error {
+	var stored gobWallet
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&stored); err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	w.PrivateKey.Curve = curve
+	w.PrivateKey.D = new(big.Int).SetBytes(stored.D)
+	w.PrivateKey.PublicKey.X, w.PrivateKey.PublicKey.Y = curve.ScalarBaseMult(stored.D)
+	w.PublicKey = stored.PublicKey
+
+	return nil
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
 	hasher := ripemd160.New()
-	if _, err := hasher.Write(pubHash[:]); err != nil {
-		log.Panic(err)
-	}
+	hasher.Write(pubHash[:]) //Writing to a hash never fails
 
 	publicRipMD := hasher.Sum(nil)
 	return publicRipMD
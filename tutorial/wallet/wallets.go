@@ -4,19 +4,23 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets.data"
+var (
+	ErrWalletNotFound = errors.New("wallet is not in the wallet file")
+)
 
 type Wallets struct {
 	Wallets map[string]*Wallet
 }
 
-func (ws *Wallets) LoadFile() error {
+//LoadFile reads the wallets saved in walletFile
+func (ws *Wallets) LoadFile(walletFile string) error {
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
@@ -37,22 +41,29 @@ func (ws *Wallets) LoadFile() error {
 	return err
 }
 
-func (ws *Wallets) SaveFile() {
+//SaveFile writes the wallets to walletFile, creating its directory if it has to
+func (ws *Wallets) SaveFile(walletFile string) error {
 	var content bytes.Buffer
 	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&content)
 	if err := encoder.Encode(ws); err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	if err := ioutil.WriteFile(walletFile, content.Bytes(), 0644); err != nil {
-		log.Panic(err)
+	if err := os.MkdirAll(filepath.Dir(walletFile), 0700); err != nil {
+		return err
 	}
+
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 }
 
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+	return *wallet, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -65,20 +76,25 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
-	address := fmt.Sprintf("%s", wallet.Address())
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := string(wallet.Address())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
-func CreateWallets() (*Wallets, error) {
+//CreateWallets loads the wallets saved in walletFile. It returns an empty set of wallets along with the error
+//if there is no such file yet
+func CreateWallets(walletFile string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
 
-	err := wallets.LoadFile()
+	err := wallets.LoadFile(walletFile)
 
 	return &wallets, err
 }